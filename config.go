@@ -7,174 +7,2529 @@ package itkconfig
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"net"
+	"net/url"
 	"os"
 	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
-// parseField parses a field based on its field type.
-func parseField(key, value string, fieldType reflect.Type) (reflect.Value, error) {
+var (
+	timeType            = reflect.TypeOf(time.Time{})
+	durationType        = reflect.TypeOf(time.Duration(0))
+	fileModeType        = reflect.TypeOf(os.FileMode(0))
+	ipType              = reflect.TypeOf(net.IP{})
+	ipNetType           = reflect.TypeOf(net.IPNet{})
+	urlType             = reflect.TypeOf(url.URL{})
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	rawType             = reflect.TypeOf(Raw(""))
+	flagValueType       = reflect.TypeOf((*flag.Value)(nil)).Elem()
+)
+
+// configField describes a struct field that can be set from a config file.
+type configField struct {
+	// key is the key used for the field in config files.
+	key string
+	// name is the name of the field in the struct.
+	name string
+	// index is the index sequence of the field, as used by FieldByIndex.
+	index []int
+	// exported is set if the field is exported or embedded.
+	exported bool
+	// options holds the options given in the itkconfig struct tag.
+	options map[string]string
+}
+
+// tagOptionNames holds the names of the options recognized in the itkconfig
+// struct tag.
+var tagOptionNames = map[string]bool{
+	"alias":      true,
+	"bytes":      true,
+	"char":       true,
+	"default":    true,
+	"deprecated": true,
+	"finite":     true,
+	"grouped":    true,
+	"json":       true,
+	"layout":     true,
+	"max":        true,
+	"min":        true,
+	"nonempty":   true,
+	"nonneg":     true,
+	"oneof":      true,
+	"percent":    true,
+	"raw":        true,
+	"required":   true,
+	"requiredif": true,
+	"secret":     true,
+	"unit":       true,
+}
+
+// parseTag parses the itkconfig struct tag of a field. The first comma
+// separated part of the tag is the config key of the field, unless it is an
+// option. An empty first part, like in itkconfig:",required", also keeps the
+// key derived from the field name. Options on the form key=value are returned
+// with their value, while flags are returned with an empty value. As option
+// values may contain commas, a part that is not a recognized option continues
+// the value of the previous option.
+func parseTag(tag reflect.StructTag) (string, map[string]string) {
+	name := ""
+	options := make(map[string]string)
+	lastOption := ""
+	for i, part := range strings.Split(tag.Get("itkconfig"), ",") {
+		option, value, _ := strings.Cut(part, "=")
+		switch {
+		case tagOptionNames[option]:
+			options[option] = value
+			lastOption = option
+		case i == 0:
+			name = part
+		case lastOption != "":
+			options[lastOption] += "," + part
+		}
+	}
+	return name, options
+}
+
+// KeyStyle decides how the keys of fields that are not named in their
+// itkconfig struct tag are derived from the field names.
+type KeyStyle int
+
+const (
+	// FieldNameKeys uses the field name as is, like AdminEmail. This is the
+	// default.
+	FieldNameKeys KeyStyle = iota
+	// SnakeCase turns AdminEmail into admin_email.
+	SnakeCase
+	// KebabCase turns AdminEmail into admin-email.
+	KebabCase
+	// LowerCase turns AdminEmail into adminemail.
+	LowerCase
+)
+
+// key returns the key of the field with the given name in style s. The words
+// of a name start at each upper case letter, except within an acronym like
+// HTTP, which is a single word.
+func (s KeyStyle) key(name string) string {
+	var sep rune
+	switch s {
+	case SnakeCase:
+		sep = '_'
+	case KebabCase:
+		sep = '-'
+	case LowerCase:
+		return strings.ToLower(name)
+	default:
+		return name
+	}
+
+	runes := []rune(name)
+	var b strings.Builder
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				b.WriteRune(sep)
+			}
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+// configFields returns the fields of t in declaration order. The key of a
+// field is the name given in the itkconfig struct tag, or the field name in
+// the given style if the tag does not name the field.
+func configFields(t reflect.Type, style KeyStyle) []configField {
+	var fields []configField
+	for _, field := range reflect.VisibleFields(t) {
+		// The fields of embedded structs are promoted, so the embedded
+		// struct itself is not set from the config.
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		if field.Anonymous && fieldType.Kind() == reflect.Struct {
+			continue
+		}
+
+		key, options := parseTag(field.Tag)
+		if key == "" {
+			key = style.key(field.Name)
+		}
+		fields = append(fields, configField{
+			key:      key,
+			name:     field.Name,
+			index:    field.Index,
+			exported: field.IsExported() || field.Anonymous,
+			options:  options,
+		})
+	}
+	return fields
+}
+
+// fieldByIndex returns the field of v with the given index sequence, like
+// FieldByIndex, but allocates nil pointers to embedded structs on the way.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, error) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !v.CanSet() {
+					return reflect.Value{}, fmt.Errorf("cannot allocate embedded pointer to unexported struct: %s", v.Type().Elem())
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, nil
+}
+
+// typeFields holds the fields of a struct type that can be set from a config
+// file.
+type typeFields struct {
+	// list holds the fields in declaration order.
+	list []configField
+	// byKey maps config keys, including aliases, to fields.
+	byKey map[string]configField
+	// err is set if the keys of two fields collide, or if a field is
+	// required if a field that does not exist is set.
+	err error
+}
+
+// byName returns the field with the given name in the struct.
+func (f *typeFields) byName(name string) (configField, bool) {
+	for _, field := range f.list {
+		if field.name == name {
+			return field, true
+		}
+	}
+	return configField{}, false
+}
+
+// fieldCacheKey identifies the fields of a struct type with keys in a style.
+type fieldCacheKey struct {
+	t     reflect.Type
+	style KeyStyle
+}
+
+// fieldCache caches the result of cachedFields for each struct type and key
+// style.
+var fieldCache sync.Map
+
+// cachedFields returns the fields of t with keys in the given style, which are
+// only derived the first time t is seen with that style.
+func cachedFields(t reflect.Type, style KeyStyle) *typeFields {
+	cacheKey := fieldCacheKey{t, style}
+	if fields, ok := fieldCache.Load(cacheKey); ok {
+		return fields.(*typeFields)
+	}
+
+	fields := &typeFields{
+		list:  configFields(t, style),
+		byKey: make(map[string]configField),
+	}
+	// Keys that only differ in case are ambiguous to the reader of a config
+	// file, so they collide as well. The aliases given by the alias option
+	// are keys of their field too.
+	type keyOf struct {
+		key   string
+		field configField
+	}
+	byFoldedKey := make(map[string]keyOf)
+	for _, field := range fields.list {
+		// Unexported fields can not be set, so their keys do not collide,
+		// but they are still found to report that they can not be set.
+		if !field.exported {
+			if _, ok := fields.byKey[field.key]; !ok {
+				fields.byKey[field.key] = field
+			}
+			continue
+		}
+		keys := []string{field.key}
+		if aliases, ok := field.options["alias"]; ok {
+			keys = append(keys, strings.Split(aliases, ",")...)
+		}
+		for _, key := range keys {
+			folded := strings.ToLower(key)
+			if other, ok := byFoldedKey[folded]; ok && fields.err == nil {
+				fields.err = fmt.Errorf("config key '%s' of field %s collides with key '%s' of field %s", key, field.name, other.key, other.field.name)
+			}
+			byFoldedKey[folded] = keyOf{key, field}
+			fields.byKey[key] = field
+		}
+	}
+	for _, field := range fields.list {
+		if name, ok := field.options["requiredif"]; ok && fields.err == nil {
+			if _, ok := fields.byName(name); !ok {
+				fields.err = fmt.Errorf("field %s is required if unknown field %s is set", field.name, name)
+			}
+		}
+	}
+	cached, _ := fieldCache.LoadOrStore(cacheKey, fields)
+	return cached.(*typeFields)
+}
+
+// byteUnits maps the lower case units accepted by parseByteSize to their size
+// in bytes. Following the SI and IEC conventions, kB is 1000 bytes while KiB
+// is 1024 bytes.
+var byteUnits = map[string]uint64{
+	"":    1,
+	"b":   1,
+	"kb":  1e3,
+	"mb":  1e6,
+	"gb":  1e9,
+	"tb":  1e12,
+	"pb":  1e15,
+	"eb":  1e18,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+	"tib": 1 << 40,
+	"pib": 1 << 50,
+	"eib": 1 << 60,
+}
+
+// parseByteSize parses a human readable byte size, such as 10MB or 512KiB,
+// into a number of bytes.
+func parseByteSize(value string) (uint64, error) {
+	end := strings.IndexFunc(value, func(r rune) bool { return r < '0' || r > '9' })
+	if end == -1 {
+		end = len(value)
+	}
+	number, unit := value[:end], strings.ToLower(strings.TrimSpace(value[end:]))
+
+	multiplier, ok := byteUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit \"%s\"", value[end:])
+	}
+	n, err := strconv.ParseUint(number, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n > math.MaxUint64/multiplier {
+		return 0, errors.New("value out of range")
+	}
+	return n * multiplier, nil
+}
+
+// parseBool parses a bool, accepting yes, no, on and off in any case in
+// addition to the values accepted by strconv.ParseBool.
+func parseBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "yes", "on":
+		return true, nil
+	case "no", "off":
+		return false, nil
+	}
+
+	v, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errors.New("accepted values are 1, t, true, yes, on, 0, f, false, no and off")
+	}
+	return v, nil
+}
+
+// intLiteral returns the integer literal value prepared for strconv, and the
+// base to parse it in. Literals with a 0x, 0o or 0b prefix are parsed
+// according to their prefix, while all other literals, including those with
+// leading zeros, are decimal. Like in Go, underscores may separate digits.
+func intLiteral(value string) (string, int) {
+	v := strings.TrimPrefix(strings.TrimPrefix(value, "-"), "+")
+	if len(v) > 2 && v[0] == '0' && strings.ContainsRune("xXoObB", rune(v[1])) {
+		return value, 0
+	}
+
+	// Base 10 does not allow underscores, so those separating two digits
+	// are removed. Any others are left for strconv to report.
+	isDigit := func(i int) bool { return i >= 0 && i < len(value) && value[i] >= '0' && value[i] <= '9' }
+	var sb strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '_' && isDigit(i-1) && isDigit(i+1) {
+			continue
+		}
+		sb.WriteByte(value[i])
+	}
+	return sb.String(), 10
+}
+
+// compare returns -1 if a is less than b, 1 if a is greater than b and 0 if
+// they are equal.
+func compare[T int64 | uint64 | float64](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// checkBounds checks that the numeric value v is within the bounds given by
+// the min and max options, that it is not negative if it has the nonneg
+// option, and that it is not infinite or NaN if it has the finite option.
+func checkBounds(key string, v reflect.Value, options map[string]string) error {
+	if _, ok := options["nonneg"]; ok && ((v.CanInt() && v.Int() < 0) || (v.CanFloat() && v.Float() < 0)) {
+		return &RangeError{Key: key, Value: fmt.Sprint(v), Msg: "can not be negative"}
+	}
+	if _, ok := options["finite"]; ok && v.CanFloat() && (math.IsInf(v.Float(), 0) || math.IsNaN(v.Float())) {
+		return &RangeError{Key: key, Value: fmt.Sprint(v), Msg: "must be a finite number"}
+	}
+
+	for _, bound := range []string{"min", "max"} {
+		limit, ok := options[bound]
+		if !ok {
+			continue
+		}
+
+		var c int
+		var err error
+		switch {
+		case v.Type() == durationType:
+			var l time.Duration
+			l, err = time.ParseDuration(limit)
+			c = compare(v.Int(), int64(l))
+		case v.CanInt():
+			var l int64
+			l, err = strconv.ParseInt(limit, 10, 64)
+			c = compare(v.Int(), l)
+		case v.CanUint():
+			var l uint64
+			l, err = strconv.ParseUint(limit, 10, 64)
+			c = compare(v.Uint(), l)
+		case v.CanFloat():
+			var l float64
+			l, err = strconv.ParseFloat(limit, 64)
+			c = compare(v.Float(), l)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid %s \"%s\" for key \"%s\": %s", bound, limit, key, err)
+		}
+
+		if bound == "min" && c < 0 {
+			return &RangeError{Key: key, Value: fmt.Sprint(v), Msg: "is below the minimum of " + limit}
+		}
+		if bound == "max" && c > 0 {
+			return &RangeError{Key: key, Value: fmt.Sprint(v), Msg: "is above the maximum of " + limit}
+		}
+	}
+	return nil
+}
+
+// checkOneOf returns an error if the field has the oneof option and value is
+// not one of the space separated values it allows.
+func checkOneOf(key, value string, options map[string]string) error {
+	oneOf, ok := options["oneof"]
+	if !ok {
+		return nil
+	}
+	allowed := strings.Fields(oneOf)
+	for _, a := range allowed {
+		if value == a {
+			return nil
+		}
+	}
+	return fmt.Errorf("value \"%s\" in key \"%s\" must be one of: %s", value, key, strings.Join(allowed, ", "))
+}
+
+// Raw is a string type for values that are kept exactly as written in the
+// config file. Quotes, escapes, comments and environment variables are left
+// as is, only the white space surrounding the value is removed.
+type Raw string
+
+// isRaw reports whether a field of type t is a Raw field, or a pointer to one.
+func isRaw(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t == rawType
+}
+
+// isJSON reports whether field is given as JSON, by the json option in its
+// struct tag. Such fields are never sections or lists, as the JSON value
+// holds the whole struct or slice.
+func isJSON(field configField) bool {
+	_, ok := field.options["json"]
+	return ok
+}
+
+// jsonValue returns the JSON value at the start of rawVal, the value of a
+// field with the json option as written. Only a comment may follow it. Quotes
+// and escapes are part of the JSON value, so unlike other values it is not
+// unquoted.
+func jsonValue(rawVal string, multiline bool, commentPrefix string) (string, error) {
+	if multiline {
+		return rawVal, nil
+	}
+	dec := json.NewDecoder(strings.NewReader(rawVal))
+	var value json.RawMessage
+	if err := dec.Decode(&value); err != nil {
+		// The value is returned as is, for the error to mention it.
+		return rawVal, nil
+	}
+	rest := strings.TrimSpace(rawVal[dec.InputOffset():])
+	if rest != "" && !isComment(rest, commentPrefix) {
+		return "", fmt.Errorf("unexpected text after JSON value: %s", rest)
+	}
+	return string(value), nil
+}
+
+// isFlagValue reports whether a field of type t is set through the Set method
+// of flag.Value, which it implements with a pointer receiver. Types that also
+// implement encoding.TextUnmarshaler are set through UnmarshalText instead, and
+// types registered with RegisterType through their parser.
+func isFlagValue(t reflect.Type) bool {
+	if _, ok := registeredParser(t); ok {
+		return false
+	}
+	ptr := reflect.PtrTo(t)
+	return t.Kind() != reflect.Ptr && ptr.Implements(flagValueType) && !ptr.Implements(textUnmarshalerType)
+}
+
+// isSection reports whether a field of type t is a struct, or a pointer to a
+// struct, that is set from a section of the config file rather than from a
+// single value. A slice of such structs gets an element for each section.
+func isSection(t reflect.Type) bool {
+	if t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || t == timeType || t == ipNetType || t == urlType {
+		return false
+	}
+	if _, ok := registeredParser(t); ok {
+		return false
+	}
+	return !reflect.PtrTo(t).Implements(textUnmarshalerType) && !isFlagValue(t)
+}
+
+// isList reports whether a field of type t is a list, whose elements are set
+// from one key-value pair each, rather than being set from a single value.
+// Byte slices and types registered with RegisterType are set from a single
+// value.
+func isList(t reflect.Type) bool {
+	if _, ok := registeredParser(t); ok {
+		return false
+	}
+	return t.Kind() == reflect.Slice && t.Elem().Kind() != reflect.Uint8 && !reflect.PtrTo(t).Implements(textUnmarshalerType) && !isFlagValue(t)
+}
+
+// overflowError returns the error for a numeric value that does not fit in
+// the size of its field type.
+func overflowError(key, value string, fieldType reflect.Type) error {
+	return fmt.Errorf("key \"%s\" value %s overflows %s", key, value, fieldType.Kind())
+}
+
+// inferValue returns value as the type it looks like, for fields of type
+// interface{}. true and false in any case are bools, and integer and floating
+// point literals are ints and float64s. Everything else is a string.
+func inferValue(value string) interface{} {
+	switch strings.ToLower(value) {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	literal, base := intLiteral(value)
+	if i, err := strconv.ParseInt(literal, base, 0); err == nil {
+		return int(i)
+	}
+	// ParseFloat also accepts words like inf and nan, which are kept as
+	// strings.
+	if f, err := strconv.ParseFloat(value, 64); err == nil && strings.ContainsAny(value, "0123456789") {
+		return f
+	}
+	return value
+}
+
+// parsers holds the parsers added with RegisterType, by type.
+var parsers = struct {
+	sync.RWMutex
+	m map[reflect.Type]func(string) (interface{}, error)
+}{m: make(map[reflect.Type]func(string) (interface{}, error))}
+
+// RegisterType makes fields of type t be parsed by fn, which has to return a
+// value assignable to t. This teaches itkconfig to handle types it does not
+// know, like UUIDs or enums, and takes precedence over any built-in handling
+// of t, including encoding.TextUnmarshaler and flag.Value. Registering a type
+// again replaces its parser. RegisterType is safe to call concurrently with
+// other calls to it and with loading configs.
+func RegisterType(t reflect.Type, fn func(value string) (interface{}, error)) {
+	parsers.Lock()
+	defer parsers.Unlock()
+	parsers.m[t] = fn
+}
+
+// RegisterParser registers fn as the parser of values for fields of type t. It
+// is the same as RegisterType.
+func RegisterParser(t reflect.Type, fn func(value string) (interface{}, error)) {
+	RegisterType(t, fn)
+}
+
+// fieldTransform identifies a field of a struct type with a transform.
+type fieldTransform struct {
+	structType reflect.Type
+	fieldName  string
+}
+
+// transforms holds the transforms added with RegisterFieldTransform.
+var transforms = struct {
+	sync.RWMutex
+	m map[fieldTransform]func(string) (string, error)
+}{m: make(map[fieldTransform]func(string) (string, error))}
+
+// RegisterFieldTransform makes the values of the field fieldName of the struct
+// type structType be passed through fn before they are parsed, such as to
+// normalize them. For slices, fn is called for each element. Registering a
+// transform for a field again replaces the previous transform.
+// RegisterFieldTransform is safe to call concurrently with loading configs.
+func RegisterFieldTransform(structType reflect.Type, fieldName string, fn func(value string) (string, error)) {
+	transforms.Lock()
+	defer transforms.Unlock()
+	transforms.m[fieldTransform{structType, fieldName}] = fn
+}
+
+// transformValues passes values through the transform registered for field of
+// structType, if any.
+func transformValues(structType reflect.Type, field configField, values []string) error {
+	transforms.RLock()
+	fn, ok := transforms.m[fieldTransform{structType, field.name}]
+	transforms.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	for i, value := range values {
+		transformed, err := fn(value)
+		if err != nil {
+			return fmt.Errorf("cannot transform value of key '%s': %w", field.key, err)
+		}
+		values[i] = transformed
+	}
+	return nil
+}
+
+// registeredParser returns the parser registered for t, if any.
+func registeredParser(t reflect.Type) (func(string) (interface{}, error), bool) {
+	parsers.RLock()
+	defer parsers.RUnlock()
+	fn, ok := parsers.m[t]
+	return fn, ok
+}
+
+// parseField parses a field based on its field type. The options from the
+// struct tag of the field are used for type specific settings, such as the
+// layout of a time.
+func parseField(key, value string, fieldType reflect.Type, options map[string]string) (reflect.Value, error) {
+	if err := checkOneOf(key, value, options); err != nil {
+		return reflect.ValueOf(nil), err
+	}
+
+	if _, ok := options["json"]; ok {
+		v := reflect.New(fieldType)
+		if err := json.Unmarshal([]byte(value), v.Interface()); err != nil {
+			return reflect.ValueOf(nil), &TypeError{Key: key, Value: value, Type: "JSON", Err: err}
+		}
+		return v.Elem(), nil
+	}
+
+	if parse, ok := registeredParser(fieldType); ok {
+		parsed, err := parse(value)
+		if err != nil {
+			return reflect.ValueOf(nil), &TypeError{Key: key, Value: value, Type: fieldType.String(), Err: err}
+		}
+		v := reflect.ValueOf(parsed)
+		if !v.IsValid() || !v.Type().AssignableTo(fieldType) {
+			return reflect.ValueOf(nil), fmt.Errorf("parser for %s returned %T for key \"%s\"", fieldType, parsed, key)
+		}
+		return v, nil
+	}
+
+	if fieldType == timeType {
+		layout, ok := options["layout"]
+		if !ok {
+			layout = time.RFC3339
+		}
+		t, err := time.Parse(layout, value)
+		if err != nil {
+			return reflect.ValueOf(nil), &TypeError{Key: key, Value: value, Type: "time", Err: fmt.Errorf("expected layout \"%s\": %w", layout, err)}
+		}
+		return reflect.ValueOf(t), nil
+	}
+
+	if fieldType == durationType {
+		// With the unit option, a bare number is a number of that unit.
+		text := value
+		if unit, ok := options["unit"]; ok {
+			if _, err := strconv.ParseFloat(value, 64); err == nil {
+				text += unit
+			}
+		}
+		d, err := time.ParseDuration(text)
+		if err != nil {
+			return reflect.ValueOf(nil), &TypeError{Key: key, Value: value, Type: "duration", Err: err}
+		}
+		v := reflect.ValueOf(d)
+		if err := checkBounds(key, v, options); err != nil {
+			return reflect.ValueOf(nil), err
+		}
+		return v, nil
+	}
+
+	if fieldType == fileModeType {
+		// Permissions are written in octal, with or without a leading 0 or
+		// 0o.
+		mode, err := strconv.ParseUint(strings.TrimPrefix(value, "0o"), 8, 32)
+		if err == nil && mode > uint64(os.ModePerm) {
+			err = errors.New("expected permission bits between 0 and 0777")
+		}
+		if err != nil {
+			return reflect.ValueOf(nil), &TypeError{Key: key, Value: value, Type: "file mode", Err: err}
+		}
+		return reflect.ValueOf(os.FileMode(mode)), nil
+	}
+
+	if fieldType == ipType {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return reflect.ValueOf(nil), &TypeError{Key: key, Value: value, Type: "IP address"}
+		}
+		return reflect.ValueOf(ip), nil
+	}
+
+	if fieldType == ipNetType {
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return reflect.ValueOf(nil), &TypeError{Key: key, Value: value, Type: "CIDR", Err: err}
+		}
+		return reflect.ValueOf(*ipNet), nil
+	}
+
+	if fieldType == urlType {
+		u, err := url.Parse(value)
+		if err != nil {
+			return reflect.ValueOf(nil), &TypeError{Key: key, Value: value, Type: "URL", Err: err}
+		}
+		return reflect.ValueOf(*u), nil
+	}
+
+	if reflect.PtrTo(fieldType).Implements(textUnmarshalerType) {
+		v := reflect.New(fieldType)
+		err := v.Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(value))
+		if err != nil {
+			return reflect.ValueOf(nil), &TypeError{Key: key, Value: value, Type: "value", Err: err}
+		}
+		return v.Elem(), nil
+	}
+
+	if isFlagValue(fieldType) {
+		v := reflect.New(fieldType)
+		if err := v.Interface().(flag.Value).Set(value); err != nil {
+			return reflect.ValueOf(nil), &TypeError{Key: key, Value: value, Type: "value", Err: err}
+		}
+		return v.Elem(), nil
+	}
+
+	if _, ok := options["char"]; ok && fieldType.Kind() == reflect.Int32 {
+		r, size := utf8.DecodeRuneInString(value)
+		if r == utf8.RuneError || size != len(value) {
+			return reflect.ValueOf(nil), &TypeError{Key: key, Value: value, Type: "char", Err: errors.New("expected a single character")}
+		}
+		return reflect.ValueOf(r).Convert(fieldType), nil
+	}
+
+	if _, ok := options["bytes"]; ok {
+		switch fieldType.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			size, err := parseByteSize(value)
+			if err != nil {
+				return reflect.ValueOf(nil), &TypeError{Key: key, Value: value, Type: "byte size", Err: err}
+			}
+			value = strconv.FormatUint(size, 10)
+		}
+	}
+
+	// With the grouped option, integers may have their digits grouped by
+	// commas, like 1,000,000.
+	if _, ok := options["grouped"]; ok {
+		switch fieldType.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			value = strings.ReplaceAll(value, ",", "")
+		}
+	}
+
 	switch fieldType.Kind() {
 	case reflect.String:
-		return reflect.ValueOf(value), nil
+		return reflect.ValueOf(value).Convert(fieldType), nil
 	case reflect.Bool:
-		v, err := strconv.ParseBool(value)
+		v, err := parseBool(value)
+		if err != nil {
+			return reflect.ValueOf(nil), &TypeError{Key: key, Value: value, Type: "bool", Err: err}
+		}
+		return reflect.ValueOf(v), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		literal, base := intLiteral(value)
+		i, err := strconv.ParseInt(literal, base, fieldType.Bits())
+		if errors.Is(err, strconv.ErrRange) {
+			return reflect.ValueOf(nil), overflowError(key, value, fieldType)
+		}
+		if err != nil {
+			return reflect.ValueOf(nil), &TypeError{Key: key, Value: value, Type: "int", Err: err}
+		}
+		v := reflect.ValueOf(i).Convert(fieldType)
+		if err := checkBounds(key, v, options); err != nil {
+			return reflect.ValueOf(nil), err
+		}
+		return v, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if strings.HasPrefix(value, "-") {
+			return reflect.ValueOf(nil), fmt.Errorf("key \"%s\" expects a non-negative integer but got \"%s\"", key, value)
+		}
+		literal, base := intLiteral(value)
+		i, err := strconv.ParseUint(literal, base, fieldType.Bits())
+		if errors.Is(err, strconv.ErrRange) {
+			return reflect.ValueOf(nil), overflowError(key, value, fieldType)
+		}
+		if err != nil {
+			return reflect.ValueOf(nil), &TypeError{Key: key, Value: value, Type: "uint", Err: err}
+		}
+		v := reflect.ValueOf(i).Convert(fieldType)
+		if err := checkBounds(key, v, options); err != nil {
+			return reflect.ValueOf(nil), err
+		}
+		return v, nil
+	case reflect.Float32, reflect.Float64:
+		// With the percent option, a value like 75% is the fraction 0.75.
+		number, percent := value, false
+		if _, ok := options["percent"]; ok && strings.HasSuffix(value, "%") {
+			number, percent = strings.TrimSpace(strings.TrimSuffix(value, "%")), true
+		}
+		i, err := strconv.ParseFloat(number, fieldType.Bits())
+		if errors.Is(err, strconv.ErrRange) {
+			return reflect.ValueOf(nil), overflowError(key, value, fieldType)
+		}
+		if err != nil {
+			return reflect.ValueOf(nil), &TypeError{Key: key, Value: value, Type: "float", Err: err}
+		}
+		if percent {
+			i /= 100
+		}
+		v := reflect.ValueOf(i).Convert(fieldType)
+		if err := checkBounds(key, v, options); err != nil {
+			return reflect.ValueOf(nil), err
+		}
+		return v, nil
+	case reflect.Slice:
+		if fieldType.Elem().Kind() != reflect.Uint8 {
+			return reflect.ValueOf(nil), fmt.Errorf("unsupported type: %s of %s", fieldType.Kind(), fieldType.Elem().Kind())
+		}
+		if _, ok := options["raw"]; ok {
+			return reflect.ValueOf([]byte(value)).Convert(fieldType), nil
+		}
+		b, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return reflect.ValueOf(nil), &TypeError{Key: key, Value: value, Type: "base64", Err: err}
+		}
+		return reflect.ValueOf(b).Convert(fieldType), nil
+	case reflect.Interface:
+		if fieldType.NumMethod() != 0 {
+			return reflect.ValueOf(nil), fmt.Errorf("unsupported type: %s", fieldType)
+		}
+		return reflect.ValueOf(inferValue(value)), nil
+	case reflect.Ptr:
+		v, err := parseField(key, value, fieldType.Elem(), options)
+		if err != nil {
+			return reflect.ValueOf(nil), err
+		}
+		ptr := reflect.New(fieldType.Elem())
+		ptr.Elem().Set(v)
+		return ptr, nil
+	default:
+		return reflect.ValueOf(nil), fmt.Errorf("unsupported type: %s", fieldType.Kind())
+	}
+}
+
+// isComment reports whether text is a comment starting with commentPrefix. An
+// empty commentPrefix disables comments.
+func isComment(text, commentPrefix string) bool {
+	return commentPrefix != "" && strings.HasPrefix(text, commentPrefix)
+}
+
+// leadingSpace returns the number of bytes of leading white space in s.
+func leadingSpace(s string) int {
+	return len(s) - len(strings.TrimLeftFunc(s, unicode.IsSpace))
+}
+
+// continued reports whether line is continued on the next line, which it is
+// when it ends with a backslash that is not escaped and not part of a comment.
+func (s *scanner) continued(line string) bool {
+	if _, comment := splitComment(line, s.commentPrefix); comment != "" {
+		return false
+	}
+	n := len(line) - len(strings.TrimRight(line, "\\"))
+	return n%2 == 1
+}
+
+// splitKeyVal splits a line into its raw key and value at the first '=' that
+// is not escaped by a backslash. It reports whether the line contains such an
+// '='.
+func splitKeyVal(line string) (string, string, bool) {
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case '=':
+			return line[:i], line[i+1:], true
+		}
+	}
+	return line, "", false
+}
+
+func parseKey(rawKey string) (*string, error) {
+	key := strings.ReplaceAll(strings.TrimSpace(rawKey), "\\=", "=")
+	if strings.Contains(key, "\"") {
+		return nil, errors.New("key cannot contain \"")
+	}
+	if key == "" {
+		return nil, errors.New("key cannot be empty")
+	}
+	// A key with white space inside would not match any field, so it is
+	// reported as a mistake in the key rather than as an unknown key.
+	if strings.IndexFunc(key, unicode.IsSpace) != -1 {
+		return nil, fmt.Errorf("key \"%s\" cannot contain white space", key)
+	}
+	return &key, nil
+}
+
+// errMissingEquals is the error for a line that is not a key-value pair.
+var errMissingEquals = errors.New("line must contain '='")
+
+// multilineDelimiter starts and ends values that span multiple lines.
+const multilineDelimiter = `"""`
+
+// readMultiline reads a value delimited by triple quotes, which may span
+// multiple lines. The first line of the value, following the opening
+// delimiter, is given in first, and any following lines are read from s. The
+// lines are kept as is, except that a line break directly after the opening
+// delimiter is removed. Only a comment may follow the closing delimiter.
+func (s *scanner) readMultiline(first string) (*string, error) {
+	var lines []string
+	text := first
+	for {
+		if end := strings.Index(text, multilineDelimiter); end != -1 {
+			lines = append(lines, text[:end])
+			rest := strings.TrimSpace(text[end+len(multilineDelimiter):])
+			if rest != "" && !isComment(rest, s.commentPrefix) {
+				return nil, fmt.Errorf("unexpected text after closing %s: %s", multilineDelimiter, rest)
+			}
+			break
+		}
+
+		lines = append(lines, text)
+		if !s.fh.Scan() {
+			if err := s.fh.Err(); err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("multi-line value is missing closing %s", multilineDelimiter)
+		}
+		s.lineNr++
+		s.text = s.fh.Text()
+		text = s.text
+	}
+
+	if len(lines) > 1 && lines[0] == "" {
+		lines = lines[1:]
+	}
+	val := strings.Join(lines, "\n")
+	return &val, nil
+}
+
+// expandEnv replaces references to environment variables on the form ${NAME}
+// in val with their values. A literal $ can be written as $$. Unset variables
+// expand to the empty string, unless errorOnUnset is true.
+func expandEnv(val string, errorOnUnset bool) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < len(val); i++ {
+		if val[i] != '$' || i+1 == len(val) {
+			sb.WriteByte(val[i])
+			continue
+		}
+
+		switch val[i+1] {
+		case '$':
+			sb.WriteByte('$')
+			i++
+		case '{':
+			end := strings.IndexByte(val[i:], '}')
+			if end == -1 {
+				return "", errors.New("unterminated environment variable reference")
+			}
+			name := val[i+2 : i+end]
+			env, ok := os.LookupEnv(name)
+			if !ok && errorOnUnset {
+				return "", fmt.Errorf("environment variable '%s' is not set", name)
+			}
+			sb.WriteString(env)
+			i += end
+		default:
+			sb.WriteByte('$')
+		}
+	}
+	return sb.String(), nil
+}
+
+// splitComment splits val into the value and any comment starting with
+// commentPrefix outside of quotes. The comment includes the white space before
+// it. Unless commentPrefix is #, the comment has to be preceded by white
+// space, so that values like http://example.com are not cut short by a //
+// prefix. An empty commentPrefix disables comments.
+func splitComment(val, commentPrefix string) (string, string) {
+	if commentPrefix == "" {
+		return val, ""
+	}
+
+	space := `\s*`
+	if commentPrefix != "#" {
+		space = `(?:^|\s+)`
+	}
+	quoteCommentGroup := regexp.MustCompile(`^("(?:\\.|[^\\])*?"|[^"]*?)(` + space + regexp.QuoteMeta(commentPrefix) + `.*)$`)
+	groups := quoteCommentGroup.FindStringSubmatchIndex(val)
+	if groups == nil {
+		return val, ""
+	}
+	return val[:groups[2*2]], val[groups[2*2]:]
+}
+
+// parseVal parses a raw value, removing quotes and any comment starting with
+// the comment prefix outside of quotes. White space around the value is
+// removed before the quotes, so white space inside quotes is kept. Only a
+// comment may follow the closing quote of a value starting with a quote, as
+// text after it is likely a mistake. Text right after the first closing quote,
+// like in "ba"r", is part of a value with quotes inside, which ends at the last
+// quote instead. column is the column of rawVal, for errors.
+func (s *scanner) parseVal(rawVal string, column int) (*string, error) {
+	column += leadingSpace(rawVal)
+	val, _ := splitComment(strings.TrimSpace(rawVal), s.commentPrefix)
+	if end := closingQuote(val); end != -1 && end < len(val)-1 {
+		at := end + 1
+		if leadingSpace(val[at:]) == 0 {
+			at = strings.LastIndex(val, "\"") + 1
+		}
+		if rest := val[at:]; rest != "" {
+			return nil, s.syntaxError(column+at+leadingSpace(rest), fmt.Errorf("unexpected text after closing quote: %s", strings.TrimSpace(rest)))
+		}
+	}
+	val = unquote(val)
+	return &val, nil
+}
+
+// closingQuote returns the index of the first quote in val that is not
+// escaped by a backslash, if val starts with a quote, or -1.
+func closingQuote(val string) int {
+	if !strings.HasPrefix(val, "\"") {
+		return -1
+	}
+	for i := 1; i < len(val); i++ {
+		switch val[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+// unquote removes non-escaped quotes from val and replaces escaped quotes.
+// A backslash escapes the quote, equals sign or backslash following it, so
+// \" gives ", \= gives = and \\ gives a single backslash. Any other backslash
+// is kept as is.
+func unquote(val string) string {
+	var sb strings.Builder
+	for i := 0; i < len(val); i++ {
+		switch {
+		case val[i] == '"':
+		case val[i] == '\\' && i+1 < len(val) && strings.IndexByte(`"=\\`, val[i+1]) != -1:
+			sb.WriteByte(val[i+1])
+			i++
+		default:
+			sb.WriteByte(val[i])
+		}
+	}
+	return sb.String()
+}
+
+// parseList parses an inline list on the form [a, b, "c, d"] into its
+// elements, which are returned as written for the caller to unquote. Commas
+// inside quotes are part of the element, and a comma after the last element
+// is allowed. Only a comment starting with commentPrefix may follow the
+// closing bracket. It reports whether rawVal is an inline list.
+func parseList(rawVal, commentPrefix string) ([]string, bool, error) {
+	val := strings.TrimSpace(rawVal)
+	if !strings.HasPrefix(val, "[") {
+		return nil, false, nil
+	}
+
+	var elems []string
+	inQuotes := false
+	start := 1
+	for i := 1; i < len(val); i++ {
+		switch {
+		case val[i] == '\\':
+			i++
+		case val[i] == '"':
+			inQuotes = !inQuotes
+		case inQuotes:
+		case val[i] == ',':
+			elems = append(elems, strings.TrimSpace(val[start:i]))
+			start = i + 1
+		case val[i] == ']':
+			// An empty list has no elements, and a trailing comma does
+			// not add an empty element.
+			if last := strings.TrimSpace(val[start:i]); last != "" {
+				elems = append(elems, last)
+			}
+			rest := strings.TrimSpace(val[i+1:])
+			if rest != "" && !isComment(rest, commentPrefix) {
+				return nil, true, fmt.Errorf("unexpected text after closing ]: %s", rest)
+			}
+			return elems, true, nil
+		}
+	}
+	return nil, true, errors.New("inline list is missing closing ]")
+}
+
+// pair is a key-value pair read from a config file.
+type pair struct {
+	key   string
+	value string
+	// rawValue is the value as written on the line, before quotes and
+	// comments are removed. For multi-line values it is the text between the
+	// delimiters.
+	rawValue string
+	// multiline reports whether the value is delimited by triple quotes.
+	multiline bool
+	// line is the line number the pair starts on.
+	line uint
+	// keyColumn and valueColumn are the 1-based byte offsets of the key and
+	// the value into their line.
+	keyColumn   int
+	valueColumn int
+	// section is the name of the section the pair is in, or empty for pairs
+	// before the first section header.
+	section string
+	// header reports whether the pair is a section header, [section], rather
+	// than a key-value pair.
+	header bool
+	// bare reports whether the pair is a key on its own, without an '=' and
+	// a value.
+	bare bool
+	// conditional reports whether the pair is in an @if block.
+	conditional bool
+}
+
+// qualifiedKey returns the key of p prefixed by its section and a dot, if it
+// is in a section.
+func (p *pair) qualifiedKey() string {
+	if p.section == "" {
+		return p.key
+	}
+	return p.section + "." + p.key
+}
+
+// byteOrderMark is the UTF-8 encoded byte order mark.
+const byteOrderMark = "\uFEFF"
+
+// scanner reads the key-value pairs of a config file, skipping blank lines and
+// comments and joining continued and multi-line values.
+type scanner struct {
+	ctx           context.Context
+	fh            *bufio.Scanner
+	source        string
+	commentPrefix string
+	// lineNr is the number of the last line read.
+	lineNr uint
+	// text is the last line read, as written.
+	text string
+	// startLine and startText are the number and text of the line the
+	// current pair starts on, which errors point at. A pair with a continued
+	// or multi-line value spans several lines.
+	startLine uint
+	startText string
+	// whitespaceSeparator makes white space separate the key and value of
+	// lines without an '='.
+	whitespaceSeparator bool
+	// bareKeys makes a key on its own on a line, without an '=', a pair
+	// with an empty value.
+	bareKeys bool
+	// vars holds the variables that the conditions of @if directives are
+	// evaluated against.
+	vars map[string]string
+	// inIf reports whether the scanner is between an @if directive and its
+	// @endif, and skipping whether the condition of the @if was false, so
+	// that the lines up to the @endif are skipped. ifLine and ifText are the
+	// number and text of the line of the @if.
+	inIf     bool
+	skipping bool
+	ifLine   uint
+	ifText   string
+	// allBlocks makes the scanner read the lines of every @if block,
+	// whatever its condition, for tools working on the file as written.
+	allBlocks bool
+	// section is the name of the current section.
+	section string
+}
+
+func newScanner(ctx context.Context, r io.Reader, source, commentPrefix string) *scanner {
+	return &scanner{
+		ctx:           ctx,
+		fh:            bufio.NewScanner(r),
+		source:        source,
+		commentPrefix: commentPrefix,
+	}
+}
+
+// maxErrorTextLength is the maximum number of bytes of a line quoted in an
+// error.
+const maxErrorTextLength = 80
+
+// syntaxError returns a ParseError for err at column of the line the current
+// pair starts on.
+func (s *scanner) syntaxError(column int, err error) error {
+	text := s.startText
+	if len(text) > maxErrorTextLength {
+		end := maxErrorTextLength
+		for end > 0 && !utf8.RuneStart(text[end]) {
+			end--
+		}
+		text = text[:end] + "..."
+	}
+	return &ParseError{
+		File:   s.source,
+		Line:   s.startLine,
+		Column: column,
+		Text:   text,
+		Msg:    err.Error(),
+		Err:    err,
+	}
+}
+
+// redacted replaces the value of a secret field in error messages.
+const redacted = "***"
+
+// redactError returns err with the value of a secret field left out. values
+// holds the value as written and as read, which may appear in err. The value
+// of a TypeError or RangeError is replaced, as it may be in another form, like
+// a number parsed from hexadecimal.
+func redactError(err error, values []string) error {
+	var typeErr *TypeError
+	var rangeErr *RangeError
+	switch {
+	case errors.As(err, &typeErr):
+		return &TypeError{Key: typeErr.Key, Value: redacted, Type: typeErr.Type}
+	case errors.As(err, &rangeErr):
+		return &RangeError{Key: rangeErr.Key, Value: redacted, Msg: rangeErr.Msg}
+	}
+	msg := err.Error()
+	for _, value := range values {
+		if value != "" {
+			msg = strings.ReplaceAll(msg, value, redacted)
+		}
+	}
+	return errors.New(msg)
+}
+
+// secretError works like syntaxError for an error about the value of p, but
+// leaves the value out of the error, as the field is secret. values holds the
+// values parsed from p, which may also appear in err.
+func (s *scanner) secretError(p *pair, values []string, err error) error {
+	err = redactError(err, append([]string{p.rawValue, p.value}, values...))
+	parseErr := s.syntaxError(p.valueColumn, err).(*ParseError)
+	parseErr.Text = redacted
+	if p.valueColumn-1 <= len(s.startText) {
+		parseErr.Text = s.startText[:p.valueColumn-1] + redacted
+	}
+	return parseErr
+}
+
+// next returns the next key-value pair, or nil when there are no more pairs.
+// It stops with the error of the context of the scanner if it is done.
+func (s *scanner) next() (*pair, error) {
+	for s.fh.Scan() {
+		if err := s.ctx.Err(); err != nil {
+			return nil, err
+		}
+		line := s.fh.Text()
+		s.lineNr++
+		if s.lineNr == 1 {
+			// Some editors start files with a byte order mark.
+			line = strings.TrimPrefix(line, byteOrderMark)
+		}
+		s.text = line
+
+		indent := leadingSpace(line)
+		line = strings.TrimSpace(line)
+		if line == "" || isComment(line, s.commentPrefix) {
+			continue
+		}
+		start := s.lineNr
+		s.startLine, s.startText = s.lineNr, s.text
+		if ok, err := s.directive(line, indent); ok || err != nil {
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if s.skipping {
+			continue
+		}
+
+		// Join lines ending with a backslash with the following line. A
+		// line ending with two backslashes ends with a literal backslash,
+		// and a backslash in a comment does not continue the line.
+		for s.continued(line) && s.fh.Scan() {
+			s.lineNr++
+			s.text = s.fh.Text()
+			line = line[:len(line)-1] + strings.TrimSpace(s.text)
+		}
+
+		// A comment after a section header may contain '=', so only the
+		// text before the comment decides whether the line is a pair.
+		if text, _ := splitComment(line, s.commentPrefix); strings.HasPrefix(text, "[") {
+			if _, _, ok := splitKeyVal(text); !ok {
+				return s.header(line, indent, start)
+			}
+		}
+		rawKey, rawVal, ok := splitKeyVal(line)
+		if !ok && s.whitespaceSeparator {
+			// The separating white space counts as the '=', so that the
+			// columns are computed the same way.
+			if i := strings.IndexFunc(line, unicode.IsSpace); i != -1 {
+				rawKey, rawVal, ok = line[:i], line[i+1:], true
+			}
+		}
+		if !ok && s.bareKeys {
+			if rawKey, _ := splitComment(line, s.commentPrefix); rawKey != "" && strings.IndexFunc(rawKey, unicode.IsSpace) == -1 {
+				key, err := parseKey(rawKey)
+				if err != nil {
+					return nil, s.syntaxError(indent+1, err)
+				}
+				// The value column is where the '=' is missing, for errors
+				// about the key needing a value.
+				return &pair{
+					key:         *key,
+					line:        start,
+					keyColumn:   indent + 1,
+					valueColumn: indent + len(line) + 1,
+					section:     s.section,
+					bare:        true,
+				}, nil
+			}
+		}
+		if !ok {
+			return nil, s.syntaxError(indent+len(line)+1, errMissingEquals)
+		}
+		// Columns are 1-based byte offsets into the line.
+		keyColumn := indent + 1
+		valueColumn := keyColumn + len(rawKey) + 1 + leadingSpace(rawVal)
+
+		key, err := parseKey(rawKey)
+		if err != nil {
+			return nil, s.syntaxError(keyColumn, err)
+		}
+
+		p := &pair{
+			key:         *key,
+			rawValue:    strings.TrimSpace(rawVal),
+			line:        start,
+			keyColumn:   keyColumn,
+			valueColumn: valueColumn,
+			section:     s.section,
+			conditional: s.inIf,
+		}
+		var value *string
+		if strings.HasPrefix(p.rawValue, multilineDelimiter) {
+			value, err = s.readMultiline(p.rawValue[len(multilineDelimiter):])
+			if err != nil {
+				return nil, s.syntaxError(valueColumn, err)
+			}
+			p.rawValue = *value
+			p.multiline = true
+		} else {
+			value, err = s.parseVal(rawVal, keyColumn+len(rawKey)+1)
+			if err != nil {
+				return nil, err
+			}
+		}
+		p.value = *value
+		return p, nil
+	}
+	if err := s.fh.Err(); err != nil {
+		return nil, err
+	}
+	if s.inIf {
+		s.startLine, s.startText = s.ifLine, s.ifText
+		return nil, s.syntaxError(leadingSpace(s.ifText)+1, errors.New("@if without @endif"))
+	}
+	return nil, nil
+}
+
+// directive handles line if it is an @if or @endif directive, which is
+// indented by indent bytes, and reports whether it is. A block starting with
+// @if NAME=value and ending with @endif is only read if the variable NAME has
+// the given value. Blocks can not be nested.
+func (s *scanner) directive(line string, indent int) (bool, error) {
+	text, _ := splitComment(line, s.commentPrefix)
+	text = strings.TrimSpace(text)
+	if text == "@endif" {
+		if !s.inIf {
+			return true, s.syntaxError(indent+1, errors.New("@endif without @if"))
+		}
+		s.inIf, s.skipping = false, false
+		return true, nil
+	}
+
+	condition := strings.TrimPrefix(text, "@if")
+	if condition == text || (condition != "" && !unicode.IsSpace(rune(condition[0]))) {
+		return false, nil
+	}
+	if s.inIf {
+		return true, s.syntaxError(indent+1, errors.New("nested @if is not supported"))
+	}
+	name, value, ok := strings.Cut(condition, "=")
+	name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+	if !ok || name == "" {
+		return true, s.syntaxError(indent+1, fmt.Errorf("invalid @if condition \"%s\", expected NAME=value", strings.TrimSpace(condition)))
+	}
+	actual, set := s.vars[name]
+	s.inIf, s.skipping = true, !s.allBlocks && (!set || actual != value)
+	s.ifLine, s.ifText = s.lineNr, s.text
+	return true, nil
+}
+
+// header parses the section header on line, which starts with '[' and is
+// indented by indent bytes, and makes it the current section. White space
+// around the name of the section is ignored, and only a comment may follow
+// the closing ].
+func (s *scanner) header(line string, indent int, start uint) (*pair, error) {
+	end := strings.Index(line, "]")
+	if end == -1 {
+		return nil, s.syntaxError(indent+len(line)+1, errors.New("section header is missing closing ]"))
+	}
+	if rest := strings.TrimSpace(line[end+1:]); rest != "" && !isComment(rest, s.commentPrefix) {
+		return nil, s.syntaxError(indent+end+2, fmt.Errorf("unexpected text after section header: %s", rest))
+	}
+	name := strings.TrimSpace(line[1:end])
+	if name == "" || strings.IndexFunc(name, unicode.IsSpace) != -1 {
+		return nil, s.syntaxError(indent+2, fmt.Errorf("invalid section name \"%s\"", name))
+	}
+
+	s.section = name
+	return &pair{
+		key:       name,
+		line:      start,
+		keyColumn: indent + 2 + leadingSpace(line[1:end]),
+		section:   name,
+		header:    true,
+	}, nil
+}
+
+// applyDefaults sets the fields of configReflect that have a default value in
+// their struct tag to that value, unless they already have a non-zero value.
+// Slice defaults are split into elements at commas. The fields of sections
+// that are not pointers get their defaults as well.
+func applyDefaults(configReflect reflect.Value, fields []configField) error {
+	for _, field := range fields {
+		def, ok := field.options["default"]
+		fieldType := configReflect.Type().FieldByIndex(field.index).Type
+		if !ok && (fieldType.Kind() != reflect.Struct || !isSection(fieldType) || isJSON(field)) {
+			continue
+		}
+
+		v, err := fieldByIndex(configReflect, field.index)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			// The defaults of a section are applied to its struct.
+			if err := applyDefaults(v, cachedFields(v.Type(), FieldNameKeys).list); err != nil {
+				return err
+			}
+			continue
+		}
+		if !v.CanSet() {
+			return fmt.Errorf("cannot set default of unexported field: '%s'", field.name)
+		}
+		if !v.IsZero() {
+			continue
+		}
+
+		if err := setString(v, field, def); err != nil {
+			return fmt.Errorf("invalid default for field '%s': %w", field.name, err)
+		}
+	}
+	return nil
+}
+
+// setString parses value as the value of field and sets v, the field, to it.
+// The value of a slice is a comma separated list of its elements.
+func setString(v reflect.Value, field configField, value string) error {
+	if !isList(v.Type()) || isJSON(field) {
+		parsed, err := parseField(field.key, value, v.Type(), field.options)
+		if err != nil {
+			return err
+		}
+		v.Set(parsed)
+		return nil
+	}
+
+	slice := reflect.MakeSlice(v.Type(), 0, 0)
+	for _, elem := range strings.Split(value, ",") {
+		parsed, err := parseField(field.key, strings.TrimSpace(elem), v.Type().Elem(), field.options)
+		if err != nil {
+			return err
+		}
+		slice = reflect.Append(slice, parsed)
+	}
+	v.Set(slice)
+	return nil
+}
+
+// envName returns the name of the environment variable for key with the given
+// prefix. The key is upper cased, and characters other than letters, digits
+// and underscores are replaced by underscores, so admin-email with the prefix
+// MYAPP_ gives MYAPP_ADMIN_EMAIL.
+func envName(prefix, key string) string {
+	return prefix + strings.Map(func(r rune) rune {
+		if r == '_' || (r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r))) {
+			return unicode.ToUpper(r)
+		}
+		return '_'
+	}, key)
+}
+
+// applyEnv sets the fields of configReflect that isSet reports as not set by
+// their name from their environment variable with the given prefix, if it is
+// set. It returns the fields it set.
+func applyEnv(configReflect reflect.Value, fields []configField, prefix string, isSet func(name string) bool) ([]configField, error) {
+	var set []configField
+	for _, field := range fields {
+		if isSet(field.name) {
+			continue
+		}
+		name := envName(prefix, field.key)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+
+		v, err := fieldByIndex(configReflect, field.index)
 		if err != nil {
-			return reflect.ValueOf(nil), fmt.Errorf("invalid bool \"%s\" in key \"%s\": %s", value, key, err)
+			return nil, err
+		}
+		if !v.CanSet() || (isSection(v.Type()) && !isJSON(field)) {
+			continue
+		}
+		if err := setString(v, field, value); err != nil {
+			if _, ok := field.options["secret"]; ok {
+				err = redactError(err, []string{value})
+			}
+			return nil, fmt.Errorf("invalid environment variable %s: %w", name, err)
+		}
+		set = append(set, field)
+	}
+	return set, nil
+}
+
+// missingKeys returns the keys of the required fields of v that have not been
+// set, as reported by isSet by their name prefixed by namePrefix. A field with
+// the requiredif option is required if the field it names has a non-zero
+// value. The fields of the sections of v are checked as well, except for nil
+// pointer sections, which were not in the config file. The keys are prefixed
+// by keyPrefix, and their section for fields of sections.
+func missingKeys(v reflect.Value, fields *typeFields, style KeyStyle, namePrefix, keyPrefix string, isSet func(name string) bool) []string {
+	var missing []string
+	for _, field := range fields.list {
+		name := namePrefix + field.name
+		fieldValue, err := v.FieldByIndexErr(field.index)
+		if err == nil && isSection(fieldValue.Type()) && !isJSON(field) {
+			elems := []reflect.Value{fieldValue}
+			names := []string{name}
+			if fieldValue.Kind() == reflect.Slice {
+				elems, names = nil, nil
+				for i := 0; i < fieldValue.Len(); i++ {
+					elems = append(elems, fieldValue.Index(i))
+					names = append(names, fmt.Sprintf("%s[%d]", name, i))
+				}
+			}
+			for i, elem := range elems {
+				if elem.Kind() == reflect.Ptr {
+					if elem.IsNil() {
+						continue
+					}
+					elem = elem.Elem()
+				}
+				sectionFields := cachedFields(elem.Type(), style)
+				missing = append(missing, missingKeys(elem, sectionFields, style, names[i]+".", field.key+".", isSet)...)
+			}
+		}
+
+		if isSet(name) {
+			continue
+		}
+		if _, ok := field.options["required"]; ok {
+			missing = append(missing, fmt.Sprintf("'%s%s'", keyPrefix, field.key))
+		} else if dependencyName, ok := field.options["requiredif"]; ok {
+			dependency, _ := fields.byName(dependencyName)
+			dependencyValue, err := v.FieldByIndexErr(dependency.index)
+			if err == nil && !dependencyValue.IsZero() {
+				missing = append(missing, fmt.Sprintf("'%s%s' (required as '%s%s' is set)", keyPrefix, field.key, keyPrefix, dependency.key))
+			}
+		}
+	}
+	return missing
+}
+
+// Validator is implemented by config types that validate themselves. If the
+// config passed to LoadConfig implements Validator, Validate is called after
+// the config has been parsed, and any error it returns is returned by
+// LoadConfig.
+type Validator interface {
+	Validate() error
+}
+
+// SliceMergeMode decides what happens to the existing elements of a slice
+// field when its key is defined in a config file.
+type SliceMergeMode int
+
+const (
+	// SliceReplace replaces the existing elements of a slice with those
+	// defined in the config file. This is the default.
+	SliceReplace SliceMergeMode = iota
+	// SliceAppend appends the elements defined in the config file to the
+	// existing elements of a slice, so that loading several config files into
+	// the same struct collects the elements from all of them.
+	SliceAppend
+)
+
+// Options changes the default behaviour of the parser. The zero value gives
+// the behaviour of LoadConfig.
+type Options struct {
+	// ErrorOnUnsetEnv makes a reference to an unset environment variable an
+	// error, instead of expanding it to the empty string.
+	ErrorOnUnsetEnv bool
+
+	// CommentPrefix is the string starting a comment, both on a line of its
+	// own and at the end of a line. If empty, # is used. A comment at the end
+	// of a line with another prefix than # has to be preceded by white space.
+	CommentPrefix string
+
+	// DisableComments turns off comments, so that # and CommentPrefix are
+	// ordinary text everywhere.
+	DisableComments bool
+
+	// StrictSliceContiguity requires all definitions of a slice key to follow
+	// each other, without other keys defined in between.
+	StrictSliceContiguity bool
+
+	// AllowUnknownKeys makes the parser skip keys that do not match any field
+	// of the config struct, instead of returning an error.
+	AllowUnknownKeys bool
+
+	// SliceMergeMode decides whether slice keys replace or append to the
+	// existing elements of their slice.
+	SliceMergeMode SliceMergeMode
+
+	// WhitespaceSeparator makes the first white space on a line without an
+	// '=' separate the key from the value, so that Foo<TAB>bar is read like
+	// Foo = bar.
+	WhitespaceSeparator bool
+
+	// BareBools lets a bool key stand on its own on a line, without an '='
+	// and a value, to set its field to true. Other keys still need an '='.
+	BareBools bool
+
+	// Vars holds the variables that the conditions of @if directives are
+	// evaluated against. The lines between @if NAME=value and @endif are
+	// only read if Vars has the given value for NAME.
+	Vars map[string]string
+
+	// RejectEmptyValues makes an empty value an error for all keys except
+	// slice keys. The nonempty option in the itkconfig struct tag does the
+	// same for a single field.
+	RejectEmptyValues bool
+
+	// KeyStyle decides the keys of fields that are not named in their
+	// itkconfig struct tag. By default the key is the field name.
+	KeyStyle KeyStyle
+
+	// EnvPrefix turns on reading fields that are not set by the config file
+	// from the environment. A field is read from the environment variable
+	// named by EnvPrefix followed by its key in upper case, so with the
+	// prefix MYAPP_ the field Port is read from MYAPP_PORT. Characters other
+	// than letters, digits and underscores in the key are replaced by
+	// underscores.
+	EnvPrefix string
+
+	// Logger, if set, is given a warning for each deprecated key in the
+	// config file, marked by the deprecated option in the itkconfig struct
+	// tag.
+	Logger *log.Logger
+
+	// IgnoreMissingFiles makes LoadConfigFilesWithOptions skip config files
+	// that do not exist, except for the first one.
+	IgnoreMissingFiles bool
+
+	// KeyPrefix is removed from the keys in the config file before they are
+	// matched against the config. Keys without the prefix are skipped, which
+	// lets several programs share a config file. In sections, the prefix is
+	// on the section name instead of on the keys.
+	KeyPrefix string
+}
+
+// A Decoder reads and decodes a configuration from an input stream.
+type Decoder struct {
+	// Options changes the behaviour of Decode.
+	Options
+
+	r      io.Reader
+	source string
+	// report, if set, is filled in with the keys set by the config.
+	report *Report
+	// merging is set when the config is one of several files loaded by
+	// LoadConfigFiles, which then applies the defaults and checks the result.
+	merging bool
+	// set, if not nil, collects the names of the fields set by the config,
+	// like the keys of lastUpdate in Decode, for LoadConfigFiles to check
+	// the required fields of all files.
+	set map[string]bool
+}
+
+// A Report describes what a config file set when it was loaded.
+type Report struct {
+	// SetKeys holds the keys defined in the config file, in the order they
+	// were first defined. Keys of fields that kept their default value are
+	// not included.
+	SetKeys []string
+}
+
+// NewDecoder returns a new decoder that reads from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: r, source: "<reader>"}
+}
+
+// gzipFile is a gzip compressed config file.
+type gzipFile struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (g *gzipFile) Close() error {
+	g.Reader.Close()
+	return g.f.Close()
+}
+
+// stdin is read for the filename "-". It is a variable so that tests can
+// replace it.
+var stdin io.Reader = os.Stdin
+
+// openConfig opens the config file filename for reading. The filename "-"
+// gives the standard input, and files with the .gz extension are
+// decompressed. Errors opening the file wrap the error of os.Open, so a
+// missing file can be detected with errors.Is(err, fs.ErrNotExist).
+func openConfig(filename string) (io.ReadCloser, error) {
+	if filename == "-" {
+		return io.NopCloser(stdin), nil
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load config: %w", err)
+	}
+	if !strings.HasSuffix(filename, ".gz") {
+		return f, nil
+	}
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("cannot decompress config (%s): %w", filename, err)
+	}
+	return &gzipFile{zr, f}, nil
+}
+
+// LoadConfig loads the provided configuration file and parses it through the
+// use of reflection according to the type definition of config, which has to be
+// a pointer to a struct. The keys after a section header, [name], set the
+// fields of the struct field with the key name. config can also be a pointer
+// to a map with string keys, which is given every key-value pair in the file,
+// with keys in sections prefixed by the section name and a dot. A file with
+// the .gz extension is decompressed with gzip before it is parsed, and the
+// filename "-" reads the config from the standard input.
+func LoadConfig(filename string, config interface{}) error {
+	return LoadConfigWithOptions(filename, config, Options{})
+}
+
+// MustLoadConfig is like LoadConfig, but panics if the config can not be
+// loaded. It simplifies loading a config that the program can not start
+// without.
+func MustLoadConfig(filename string, config interface{}) {
+	if err := LoadConfig(filename, config); err != nil {
+		panic(err)
+	}
+}
+
+// Load loads the configuration file filename into a new T, like LoadConfig,
+// and returns it. T has to be a struct or a map with string keys.
+func Load[T any](filename string) (T, error) {
+	var config T
+	err := LoadConfig(filename, &config)
+	return config, err
+}
+
+// Validate checks that the config file filename can be loaded into config,
+// without changing config. Only the type of config is used, so it can be a
+// nil pointer, like (*Config)(nil).
+func Validate(filename string, config interface{}) error {
+	t := reflect.TypeOf(config)
+	if t == nil || t.Kind() != reflect.Ptr {
+		return errors.New("config argument must be a pointer")
+	}
+	return LoadConfig(filename, reflect.New(t.Elem()).Interface())
+}
+
+// LoadConfigWithOptions works like LoadConfig, but uses opts to change the
+// behaviour of the parser.
+func LoadConfigWithOptions(filename string, config interface{}, opts Options) error {
+	f, err := openConfig(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	d := NewDecoder(f)
+	d.Options = opts
+	d.source = filename
+	return d.Decode(config)
+}
+
+// LoadConfigFiles loads several config files into the same config, in order.
+// A key defined in a later file overrides the value from an earlier file, so
+// that a base config can be adjusted by, for instance, a file for each
+// environment. Defaults are applied and required keys are checked once, for
+// all the files together.
+func LoadConfigFiles(config interface{}, filenames ...string) error {
+	return LoadConfigFilesWithOptions(config, Options{}, filenames...)
+}
+
+// LoadConfigFilesWithOptions works like LoadConfigFiles, but with options.
+// Slice keys replace or append to the elements from earlier files according
+// to opts.SliceMergeMode.
+func LoadConfigFilesWithOptions(config interface{}, opts Options, filenames ...string) error {
+	if len(filenames) == 0 {
+		return errors.New("no config files given")
+	}
+
+	configReflect := reflect.ValueOf(config)
+	if configReflect.Kind() != reflect.Ptr {
+		return errors.New("config argument must be a pointer")
+	}
+	configReflect = configReflect.Elem()
+	var fields *typeFields
+	if configReflect.Kind() == reflect.Struct {
+		fields = cachedFields(configReflect.Type(), opts.KeyStyle)
+		if fields.err != nil {
+			return fields.err
 		}
-		return reflect.ValueOf(v), nil
-	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		i, err := strconv.ParseInt(value, 10, fieldType.Bits())
+		if err := applyDefaults(configReflect, fields.list); err != nil {
+			return err
+		}
+	}
+
+	report := &Report{}
+	set := make(map[string]bool)
+	for i, filename := range filenames {
+		f, err := openConfig(filename)
 		if err != nil {
-			return reflect.ValueOf(nil), fmt.Errorf("invalid int \"%s\" in key \"%s\": %s", value, key, err)
+			if i > 0 && opts.IgnoreMissingFiles && errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return err
 		}
-		return reflect.ValueOf(i).Convert(fieldType), nil
-	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
-		i, err := strconv.ParseUint(value, 10, fieldType.Bits())
+
+		d := NewDecoder(f)
+		d.Options = opts
+		d.source = filename
+		d.report = report
+		d.merging = true
+		d.set = set
+		err = d.Decode(config)
+		f.Close()
 		if err != nil {
-			return reflect.ValueOf(nil), fmt.Errorf("invalid uint \"%s\" in key \"%s\": %s", value, key, err)
+			return err
 		}
-		return reflect.ValueOf(i).Convert(fieldType), nil
-	case reflect.Float32, reflect.Float64:
-		i, err := strconv.ParseFloat(value, fieldType.Bits())
+	}
+
+	if fields == nil {
+		return nil
+	}
+	isSet := func(name string) bool {
+		return set[name]
+	}
+	if opts.EnvPrefix != "" {
+		envSet, err := applyEnv(configReflect, fields.list, opts.EnvPrefix, isSet)
 		if err != nil {
-			return reflect.ValueOf(nil), fmt.Errorf("invalid float \"%s\" in key \"%s\": %s", value, key, err)
+			return err
+		}
+		for _, field := range envSet {
+			set[field.name] = true
 		}
-		return reflect.ValueOf(i).Convert(fieldType), nil
-	default:
-		return reflect.ValueOf(nil), fmt.Errorf("unsupported type: %s", fieldType.Kind())
 	}
+	return checkConfig(config, fields, opts.KeyStyle, isSet, strings.Join(filenames, ", "))
 }
 
-func parseKey(rawKey string) (*string, error) {
-	key := strings.TrimSpace(rawKey)
-	if strings.Contains(key, "\"") {
-		return nil, errors.New("key cannot contain \"")
+// LoadConfigOptional works like LoadConfig, but returns nil and leaves config
+// unchanged if filename does not exist. This suits an override file that may
+// or may not be present.
+func LoadConfigOptional(filename string, config interface{}) error {
+	f, err := openConfig(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
 	}
-	if key == "" {
-		return nil, errors.New("key cannot be empty")
+	if err != nil {
+		return err
 	}
-	return &key, nil
+	defer f.Close()
+
+	d := NewDecoder(f)
+	d.source = filename
+	return d.Decode(config)
 }
 
-func parseVal(rawVal string) (*string, error) {
-	val := strings.TrimSpace(rawVal)
+// LoadConfigReport works like LoadConfig, but also returns a report of which
+// keys the config file set.
+func LoadConfigReport(filename string, config interface{}) (*Report, error) {
+	f, err := openConfig(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
 
-	quoteCommentGroup := regexp.MustCompile(`^(".*?"|[^"]*?)(\s*#.*)$`)
-	groups := quoteCommentGroup.FindStringSubmatchIndex(val)
-	if groups != nil {
-		val = val[:groups[2*2]]
+	report := &Report{}
+	d := NewDecoder(f)
+	d.source = filename
+	d.report = report
+	if err := d.Decode(config); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// LoadConfigFS works like LoadConfig, but reads the configuration file name
+// from fsys, such as an embed.FS.
+func LoadConfigFS(fsys fs.FS, name string, config interface{}) error {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return fmt.Errorf("cannot load config: %w", err)
 	}
+	defer f.Close()
 
-	// Remove non-escaped quotes and replace escaped quotes.
-	var sb strings.Builder
-	for i, r := range val {
-		if r == '"' {
+	d := NewDecoder(f)
+	d.source = name
+	return d.Decode(config)
+}
+
+// LoadConfigFromReader works like LoadConfig, but reads the configuration from
+// r instead of from a file.
+func LoadConfigFromReader(r io.Reader, config interface{}) error {
+	return NewDecoder(r).Decode(config)
+}
+
+// LoadConfigContext works like LoadConfigFromReader, but stops reading r and
+// returns the error of ctx if ctx is done before the whole configuration has
+// been read.
+func LoadConfigContext(ctx context.Context, r io.Reader, config interface{}) error {
+	return NewDecoder(r).DecodeContext(ctx, config)
+}
+
+// LoadConfigString works like LoadConfig, but parses the configuration given
+// in s.
+func LoadConfigString(s string, config interface{}) error {
+	d := NewDecoder(strings.NewReader(s))
+	d.source = "<string>"
+	return d.Decode(config)
+}
+
+// Unmarshal parses the configuration in data into config, like LoadConfig. It
+// is the inverse of Marshal.
+func Unmarshal(data []byte, config interface{}) error {
+	d := NewDecoder(bytes.NewReader(data))
+	d.source = "<data>"
+	return d.Decode(config)
+}
+
+// Walk reads the configuration from r and calls fn for each key-value pair in
+// it, in the order they appear, without parsing them into a struct. The value
+// has its quotes and comments removed like in LoadConfig, but environment
+// variables are not expanded. Keys in a section are prefixed by the name of
+// the section and a dot, like database.Port. line is the line number the pair
+// starts on. The pairs in @if blocks are included whatever their condition.
+// If fn returns an error, Walk stops and returns that error.
+func Walk(r io.Reader, fn func(key, value string, line uint) error) error {
+	s := newScanner(context.Background(), r, "<reader>", "#")
+	s.allBlocks = true
+	for {
+		p, err := s.next()
+		if err != nil {
+			return err
+		}
+		if p == nil {
+			return nil
+		}
+		if p.header {
 			continue
 		}
+		if err := fn(p.qualifiedKey(), p.value, p.line); err != nil {
+			return err
+		}
+	}
+}
 
-		if val[i] == '\\' && val[i+1] == '"' {
-			sb.WriteRune('"')
-		} else {
-			sb.WriteRune(r)
+// fieldValues returns the values of p to parse into a field of type t. If
+// list is true, an inline list is split into its elements. Environment
+// variables are expanded in the values, and values referring to a file, like
+// @/etc/keys/tls.pem, are read from it, except for Raw fields, which are given
+// the value as written. Quoted and multi-line values never refer to a file,
+// and a value written with \@ at the start starts with a literal @.
+func (d *Decoder) fieldValues(p *pair, t reflect.Type, list bool, commentPrefix string) ([]string, error) {
+	if isRaw(t) {
+		return []string{p.rawValue}, nil
+	}
+
+	values := []string{p.value}
+	// written holds the values as written, which are quoted for quoted
+	// and multi-line values.
+	written := []string{p.rawValue}
+	if list && !p.multiline {
+		elems, ok, err := parseList(p.rawValue, commentPrefix)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			values, written = make([]string, len(elems)), elems
+			for i, elem := range elems {
+				values[i] = unquote(elem)
+			}
 		}
 	}
-	val = sb.String()
 
-	return &val, nil
+	for i, value := range values {
+		// Whether a value refers to a file is decided by the value as
+		// written, so that an environment variable can not make it one.
+		fromFile := strings.HasPrefix(written[i], "@")
+		if strings.HasPrefix(written[i], "\\@") {
+			value = value[1:]
+		}
+		value, err := expandEnv(value, d.ErrorOnUnsetEnv)
+		if err != nil {
+			return nil, err
+		}
+		if fromFile {
+			value, err = readValueFile(value[1:])
+			if err != nil {
+				return nil, err
+			}
+		}
+		values[i] = value
+	}
+	return values, nil
 }
 
-// LoadConfig loads the provided configuration file and parses it through the
-// use of reflection according to the type definition of config, which has to be
-// a pointer to a struct.
-func LoadConfig(filename string, config interface{}) error {
-	// Use reflect to place config keys into the right element in the struct
-	configPtrReflect := reflect.ValueOf(config)
-	if configPtrReflect.Kind() != reflect.Ptr {
-		return errors.New("config argument must be a pointer")
+// readValueFile returns the contents of the file filename, without a trailing
+// newline.
+func readValueFile(filename string) (string, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return "", fmt.Errorf("cannot read value from file: %w", err)
 	}
-	configReflect := configPtrReflect.Elem()
-	if configReflect.Kind() != reflect.Struct {
-		return errors.New("config argument must be a pointer to a struct")
+	contents := strings.TrimSuffix(string(data), "\n")
+	return strings.TrimSuffix(contents, "\r"), nil
+}
+
+// checkEmpty returns an error if value is empty and empty values are rejected
+// for the key, either by the RejectEmptyValues option or by the nonempty
+// option of the field.
+func (d *Decoder) checkEmpty(key, value string, options map[string]string) error {
+	_, nonempty := options["nonempty"]
+	if value == "" && (d.RejectEmptyValues || nonempty) {
+		return fmt.Errorf("key '%s' can not have an empty value", key)
 	}
+	return nil
+}
 
-	lastUpdate := make(map[string]uint)
-	for _, field := range reflect.VisibleFields(configReflect.Type()) {
-		lastUpdate[field.Name] = 0
+// trimKeyPrefix removes the KeyPrefix option from key. It reports whether key
+// has the prefix.
+func (d *Decoder) trimKeyPrefix(key string) (string, bool) {
+	if !strings.HasPrefix(key, d.KeyPrefix) {
+		return "", false
 	}
+	return key[len(d.KeyPrefix):], true
+}
 
-	f, err := os.Open(filename)
-	if err != nil {
-		return err
+// trimPairPrefix removes the KeyPrefix option from the key of p, or from its
+// section if it is in one, as the keys of a section belong to the section. It
+// reports whether p has the prefix.
+func (d *Decoder) trimPairPrefix(p *pair) bool {
+	if p.section == "" {
+		key, ok := d.trimKeyPrefix(p.key)
+		p.key = key
+		return ok
 	}
-	defer f.Close()
-	fh := bufio.NewScanner(f)
+	section, ok := d.trimKeyPrefix(p.section)
+	if !ok {
+		return false
+	}
+	p.section = section
+	if p.header {
+		p.key = section
+	}
+	return true
+}
+
+// markSet records that the field with the given name was set, for
+// LoadConfigFiles.
+func (d *Decoder) markSet(name string) {
+	if d.set != nil {
+		d.set[name] = true
+	}
+}
 
-	lineNr := uint(0)
-	syntaxError := func(message string) error {
-		return fmt.Errorf("syntax error parsing config (%s:%d): %s", filename, lineNr, message)
+// reportKey adds key to the report of the decoder, if it has one.
+func (d *Decoder) reportKey(key string) {
+	if d.report != nil {
+		d.report.SetKeys = append(d.report.SetKeys, key)
 	}
+}
 
-	for fh.Scan() {
-		line := fh.Text()
-		lineNr++
+// negationPrefix turns a key for a bool field into a key setting it to false.
+const negationPrefix = "no-"
 
-		line = strings.TrimSpace(line)
-		if line == "" || line[0] == '#' {
+// negatedBool returns the bool field of t that key turns off, if key is the
+// key of a bool field with negationPrefix in front. It reports whether there
+// is such a field.
+func negatedBool(t reflect.Type, fields *typeFields, key string) (configField, bool) {
+	if !strings.HasPrefix(key, negationPrefix) {
+		return configField{}, false
+	}
+	field, ok := fields.byKey[key[len(negationPrefix):]]
+	if !ok {
+		return configField{}, false
+	}
+	fieldType := t.FieldByIndex(field.index).Type
+	if fieldType.Kind() == reflect.Ptr {
+		fieldType = fieldType.Elem()
+	}
+	return field, fieldType.Kind() == reflect.Bool
+}
+
+// commentPrefix returns the string starting a comment, which is # unless
+// another prefix is set in the options. It is empty if comments are disabled.
+func (d *Decoder) commentPrefix() string {
+	if d.DisableComments {
+		return ""
+	}
+	if d.CommentPrefix == "" {
+		return "#"
+	}
+	return d.CommentPrefix
+}
+
+// decodeMap reads every key-value pair from the input of the decoder into m,
+// which has to be a map with string keys. Values are parsed as the element
+// type of the map, except for interface{} elements, which are set to the value
+// as a string. Like non-slice fields, a key can only be defined once.
+func (d *Decoder) decodeMap(ctx context.Context, m reflect.Value) error {
+	if m.IsNil() {
+		m.Set(reflect.MakeMap(m.Type()))
+	}
+	elemType := m.Type().Elem()
+	lastUpdate := make(map[string]uint)
+
+	commentPrefix := d.commentPrefix()
+	s := newScanner(ctx, d.r, d.source, commentPrefix)
+	s.whitespaceSeparator = d.WhitespaceSeparator
+	s.bareKeys = d.BareBools
+	s.vars = d.Vars
+	for {
+		p, err := s.next()
+		if err != nil {
+			return err
+		}
+		if p == nil {
+			return nil
+		}
+		if p.header || !d.trimPairPrefix(p) {
 			continue
 		}
+		// Keys in sections are prefixed by the section, like
+		// database.Port.
+		p.key = p.qualifiedKey()
+
+		if lastUpdate[p.key] != 0 {
+			return s.syntaxError(p.keyColumn, fmt.Errorf("key '%s' was defined multiple times, initially on line %d", p.key, lastUpdate[p.key]))
+		}
+		if p.bare {
+			if elemType.Kind() != reflect.Bool {
+				return s.syntaxError(p.valueColumn, errMissingEquals)
+			}
+			p.value = "true"
+		}
+		values, err := d.fieldValues(p, elemType, false, commentPrefix)
+		if err != nil {
+			return s.syntaxError(p.valueColumn, err)
+		}
 
-		keyVal := strings.SplitN(line, "=", 2)
-		if len(keyVal) != 2 {
-			return syntaxError("line must contain '='")
+		v := reflect.ValueOf(values[0])
+		if elemType.Kind() != reflect.Interface {
+			v, err = parseField(p.key, values[0], elemType, nil)
+			if err != nil {
+				return s.syntaxError(p.valueColumn, err)
+			}
 		}
+		m.SetMapIndex(reflect.ValueOf(p.key).Convert(m.Type().Key()), v)
+		d.reportKey(p.key)
+		lastUpdate[p.key] = p.line
+	}
+}
 
-		key, err := parseKey(keyVal[0])
+// Decode reads the configuration from the input of the decoder and parses it
+// into config, in the same way as LoadConfig.
+func (d *Decoder) Decode(config interface{}) error {
+	return d.DecodeContext(context.Background(), config)
+}
+
+// DecodeContext works like Decode, but stops reading the input and returns the
+// error of ctx if ctx is done before the whole configuration has been read.
+func (d *Decoder) DecodeContext(ctx context.Context, config interface{}) error {
+	// Use reflect to place config keys into the right element in the struct
+	configPtrReflect := reflect.ValueOf(config)
+	if configPtrReflect.Kind() != reflect.Ptr {
+		return errors.New("config argument must be a pointer")
+	}
+	configReflect := configPtrReflect.Elem()
+	if configReflect.Kind() == reflect.Map && configReflect.Type().Key().Kind() == reflect.String {
+		return d.decodeMap(ctx, configReflect)
+	}
+	if configReflect.Kind() != reflect.Struct {
+		return errors.New("config argument must be a pointer to a struct or a map with string keys")
+	}
+
+	fields := cachedFields(configReflect.Type(), d.KeyStyle)
+	if fields.err != nil {
+		return fields.err
+	}
+	if !d.merging {
+		err := applyDefaults(configReflect, fields.list)
 		if err != nil {
-			return syntaxError(err.Error())
+			return err
 		}
+	}
+	// lastUpdate holds the line each field was last set on, by the name of
+	// the field prefixed by the name of its section field.
+	lastUpdate := make(map[string]uint)
+	// lastField is the name of the field set by the previous key.
+	lastField := ""
+	// target is the struct keys are set in, which is the struct of the
+	// current section or the config itself, and targetFields are its fields.
+	target, targetFields := configReflect, fields
+	// namePrefix is the name of the field of the current section and a dot.
+	namePrefix := ""
+	// skipSection is set in an unknown section, whose keys are skipped when
+	// unknown keys are allowed.
+	skipSection := false
 
-		value, err := parseVal(keyVal[1])
+	commentPrefix := d.commentPrefix()
+	s := newScanner(ctx, d.r, d.source, commentPrefix)
+	s.whitespaceSeparator = d.WhitespaceSeparator
+	s.bareKeys = d.BareBools
+	s.vars = d.Vars
+	for {
+		p, err := s.next()
 		if err != nil {
-			return syntaxError(err.Error())
+			return err
+		}
+		if p == nil {
+			break
+		}
+		if !d.trimPairPrefix(p) {
+			continue
+		}
+		if p.header {
+			sectionField, ok := fields.byKey[p.key]
+			if !ok || !isSection(configReflect.Type().FieldByIndex(sectionField.index).Type) || isJSON(sectionField) {
+				if d.AllowUnknownKeys {
+					skipSection = true
+					continue
+				}
+				return s.syntaxError(p.keyColumn, fmt.Errorf("section '%s' is not defined", p.key))
+			}
+			skipSection = false
+			field, err := fieldByIndex(configReflect, sectionField.index)
+			if err != nil {
+				return s.syntaxError(p.keyColumn, err)
+			}
+			if !field.CanSet() {
+				return s.syntaxError(p.keyColumn, fmt.Errorf("cannot set unexported field: '%s'", p.key))
+			}
+			namePrefix = sectionField.name + "."
+			if field.Kind() == reflect.Slice {
+				// Every header of a slice section adds an element to the
+				// slice, which the keys that follow are set in.
+				if lastUpdate[sectionField.name] == 0 && d.SliceMergeMode == SliceReplace {
+					field.Set(reflect.MakeSlice(field.Type(), 0, 0))
+					// The elements set by earlier files are gone.
+					for name := range d.set {
+						if strings.HasPrefix(name, sectionField.name+"[") {
+							delete(d.set, name)
+						}
+					}
+				}
+				index := field.Len()
+				field.Set(reflect.Append(field, reflect.New(field.Type().Elem()).Elem()))
+				field = field.Index(index)
+				namePrefix = fmt.Sprintf("%s[%d].", sectionField.name, index)
+			}
+			if field.Kind() == reflect.Ptr {
+				if field.IsNil() {
+					field.Set(reflect.New(field.Type().Elem()))
+				}
+				field = field.Elem()
+			}
+			// The defaults of sections allocated while decoding are applied
+			// here, as they did not exist when the defaults were applied.
+			if field.IsZero() {
+				if err := applyDefaults(field, cachedFields(field.Type(), FieldNameKeys).list); err != nil {
+					return s.syntaxError(p.keyColumn, err)
+				}
+			}
+			target, targetFields = field, cachedFields(field.Type(), d.KeyStyle)
+			if targetFields.err != nil {
+				return s.syntaxError(p.keyColumn, targetFields.err)
+			}
+			if lastUpdate[sectionField.name] == 0 {
+				d.reportKey(sectionField.key)
+			}
+			lastUpdate[sectionField.name] = p.line
+			d.markSet(sectionField.name)
+			continue
+		}
+		if skipSection {
+			continue
 		}
 
-		field := configReflect.FieldByName(*key)
-		if !field.IsValid() {
-			return syntaxError(fmt.Sprintf("the config key '%s' is not defined", *key))
+		configField, ok := targetFields.byKey[p.key]
+		if !ok {
+			if configField, ok = negatedBool(target.Type(), targetFields, p.key); ok {
+				if p.value != "" {
+					return s.syntaxError(p.valueColumn, fmt.Errorf("key '%s' turns off '%s' and can not have a value", p.key, configField.key))
+				}
+				p.value = "false"
+			}
+		}
+		if !ok {
+			if d.AllowUnknownKeys {
+				continue
+			}
+			return s.syntaxError(p.keyColumn, &UnknownKeyError{Key: p.qualifiedKey(), Line: p.line})
+		}
+		if p.bare && p.value == "" {
+			// Only bool fields can be set by their key alone.
+			fieldType := target.Type().FieldByIndex(configField.index).Type
+			if fieldType.Kind() == reflect.Ptr {
+				fieldType = fieldType.Elem()
+			}
+			if fieldType.Kind() != reflect.Bool {
+				return s.syntaxError(p.valueColumn, errMissingEquals)
+			}
+			p.value = "true"
+		}
+		// name and fieldKey identify the field among the fields of all
+		// sections.
+		name := namePrefix + configField.name
+		fieldKey := configField.key
+		if p.section != "" {
+			fieldKey = p.section + "." + fieldKey
+		}
+		field, err := fieldByIndex(target, configField.index)
+		if err != nil {
+			return s.syntaxError(p.keyColumn, err)
 		}
 		if !field.CanSet() {
-			return syntaxError(fmt.Sprintf("cannot set unexported field: '%s'", *key))
+			return s.syntaxError(p.keyColumn, fmt.Errorf("cannot set unexported field: '%s'", p.key))
 		}
 
-		switch field.Kind() {
-		case reflect.Slice:
-			if lastUpdate[*key] == 0 {
-				field.Set(reflect.MakeSlice(field.Type(), 0, 0))
+		// valueError returns the error for an invalid value, which is left
+		// out of the error for secret fields.
+		var values []string
+		valueError := func(err error) error {
+			if _, ok := configField.options["secret"]; ok {
+				return s.secretError(p, values, err)
+			}
+			return s.syntaxError(p.valueColumn, err)
+		}
+
+		switch {
+		case isJSON(configField):
+			if lastUpdate[name] != 0 {
+				return s.syntaxError(p.keyColumn, fmt.Errorf("key '%s' was defined multiple times, initially on line %d", p.key, lastUpdate[name]))
 			}
 
-			v, err := parseField(*key, *value, field.Type().Elem())
+			value, err := jsonValue(p.rawValue, p.multiline, commentPrefix)
+			if err != nil {
+				return valueError(err)
+			}
+			values = []string{value}
+			if err := transformValues(target.Type(), configField, values); err != nil {
+				return valueError(err)
+			}
+			v, err := parseField(p.key, values[0], field.Type(), configField.options)
+			if err != nil {
+				return valueError(err)
+			}
+			field.Set(v)
+		case isFlagValue(field.Type()):
+			// Like for command line flags, Set is called for every
+			// definition of the key, so a flag.Value can accumulate values.
+			values, err = d.fieldValues(p, field.Type(), false, commentPrefix)
+			if err == nil {
+				err = transformValues(target.Type(), configField, values)
+			}
 			if err != nil {
-				return syntaxError(err.Error())
+				return valueError(err)
+			}
+			if err := d.checkEmpty(p.key, values[0], configField.options); err != nil {
+				return valueError(err)
+			}
+			if err := field.Addr().Interface().(flag.Value).Set(values[0]); err != nil {
+				return valueError(&TypeError{Key: p.key, Value: values[0], Type: "value", Err: err})
+			}
+		case isList(field.Type()):
+			if lastUpdate[name] == 0 && d.SliceMergeMode == SliceReplace {
+				field.Set(reflect.MakeSlice(field.Type(), 0, 0))
+			} else if d.StrictSliceContiguity && lastUpdate[name] != 0 && lastField != name {
+				return s.syntaxError(p.keyColumn, fmt.Errorf("definitions of slice key '%s' must be contiguous, but it was previously defined on line %d", p.key, lastUpdate[name]))
 			}
 
-			field.Set(reflect.Append(field, v))
+			values, err = d.fieldValues(p, field.Type().Elem(), true, commentPrefix)
+			if err == nil {
+				err = transformValues(target.Type(), configField, values)
+			}
+			if err != nil {
+				return valueError(err)
+			}
+			if len(values) == 0 {
+				// An empty inline list, Key = [], clears the slice,
+				// including elements from earlier files or lines.
+				field.Set(reflect.MakeSlice(field.Type(), 0, 0))
+			}
+			for _, value := range values {
+				v, err := parseField(p.key, value, field.Type().Elem(), configField.options)
+				if err != nil {
+					return valueError(err)
+				}
+				field.Set(reflect.Append(field, v))
+			}
 		default:
-			if lastUpdate[*key] != 0 {
-				return syntaxError(fmt.Sprintf("key '%s' was defined multiple times, initially on line %d (did you mean to define a slice?)", *key, lastUpdate[*key]))
+			if lastUpdate[name] != 0 {
+				return s.syntaxError(p.keyColumn, fmt.Errorf("key '%s' was defined multiple times, initially on line %d (did you mean to define a slice?)", p.key, lastUpdate[name]))
 			}
 
-			v, err := parseField(*key, *value, field.Type())
+			values, err = d.fieldValues(p, field.Type(), false, commentPrefix)
+			if err == nil {
+				err = transformValues(target.Type(), configField, values)
+			}
+			if err != nil {
+				return valueError(err)
+			}
+			if err := d.checkEmpty(p.key, values[0], configField.options); err != nil {
+				return valueError(err)
+			}
+			v, err := parseField(p.key, values[0], field.Type(), configField.options)
 			if err != nil {
-				return syntaxError(err.Error())
+				return valueError(err)
 			}
 			field.Set(v)
 		}
-		lastUpdate[*key] = lineNr
+		if lastUpdate[name] == 0 {
+			d.reportKey(fieldKey)
+			if message, ok := configField.options["deprecated"]; ok && d.Logger != nil {
+				d.Logger.Printf("config key '%s' (%s:%d) is deprecated: %s", fieldKey, d.source, p.line, message)
+			}
+		}
+		lastUpdate[name] = p.line
+		lastField = name
+		d.markSet(name)
+	}
+
+	if d.merging {
+		return nil
+	}
+	isSet := func(name string) bool {
+		return lastUpdate[name] != 0
+	}
+	if d.EnvPrefix != "" {
+		set, err := applyEnv(configReflect, fields.list, d.EnvPrefix, isSet)
+		if err != nil {
+			return err
+		}
+		// Fields set from the environment count as set when required
+		// keys are checked.
+		for _, field := range set {
+			d.reportKey(field.key)
+			lastUpdate[field.name] = 1
+		}
+	}
+	return checkConfig(config, fields, d.KeyStyle, isSet, d.source)
+}
+
+// checkConfig returns an error if a required field of config has not been set,
+// as reported by isSet, or if config implements Validator and is not valid.
+// The fields of sections have keys in the given style.
+func checkConfig(config interface{}, fields *typeFields, style KeyStyle, isSet func(name string) bool, source string) error {
+	missing := missingKeys(reflect.ValueOf(config).Elem(), fields, style, "", "", isSet)
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required keys in config (%s): %s", source, strings.Join(missing, ", "))
+	}
+
+	if validator, ok := config.(Validator); ok {
+		if err := validator.Validate(); err != nil {
+			return fmt.Errorf("invalid config (%s): %w", source, err)
+		}
 	}
 
 	return nil
@@ -1,10 +1,49 @@
 package itkconfig
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/url"
+	"os"
 	"reflect"
+	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
 )
 
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l *LogLevel) UnmarshalText(text []byte) error {
+	for i, name := range logLevelNames {
+		if string(text) == name {
+			*l = LogLevel(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown log level: %s", text)
+}
+
+func (l LogLevel) MarshalText() ([]byte, error) {
+	return []byte(logLevelNames[l]), nil
+}
+
 func TestString(t *testing.T) {
 	type Config struct {
 		Foo string
@@ -501,3 +540,3144 @@ Could not parse config with string slice with nil default.
 	}
 
 }
+
+func TestTime(t *testing.T) {
+	type Config struct {
+		StartDate time.Time
+		Day       time.Time `itkconfig:"layout=2006-01-02"`
+	}
+
+	config := Config{}
+	err := LoadConfig("test_configs/time.cfg", &config)
+	if err != nil {
+		t.Fatalf("Could not parse time value: %s", err.Error())
+	}
+
+	want := Config{
+		StartDate: time.Date(2023, 1, 2, 15, 4, 5, 0, time.UTC),
+		Day:       time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC),
+	}
+	if !want.StartDate.Equal(config.StartDate) || !want.Day.Equal(config.Day) {
+		t.Fatalf(`
+Could not parse config containing time.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+}
+
+func TestInvalidTime(t *testing.T) {
+	type Config struct {
+		Day time.Time `itkconfig:"layout=2006-01-02"`
+	}
+
+	err := LoadConfig("test_configs/invalidtime.cfg", &Config{})
+	if err == nil {
+		t.Fatal("Time not matching the layout should not be allowed.")
+	}
+	if !strings.Contains(err.Error(), "2006-01-02") {
+		t.Fatalf("Error should mention the expected layout, got: %s", err.Error())
+	}
+}
+
+func TestLoadConfigFromReader(t *testing.T) {
+	type Config struct {
+		Foo string
+		Bar []int
+	}
+
+	config := Config{}
+	err := LoadConfigFromReader(strings.NewReader("Foo = \"bar\"\nBar = 1\nBar = 2\n"), &config)
+	if err != nil {
+		t.Fatalf("Could not parse config from reader: %s", err.Error())
+	}
+
+	want := Config{
+		Foo: "bar",
+		Bar: []int{1, 2},
+	}
+	if !reflect.DeepEqual(want, config) {
+		t.Fatalf(`
+Could not parse config from reader.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+}
+
+func TestLoadConfigFromReaderError(t *testing.T) {
+	type Config struct {
+		Foo int
+	}
+
+	err := LoadConfigFromReader(strings.NewReader("Foo = bar\n"), &Config{})
+	if err == nil {
+		t.Fatal("Invalid int from reader should not be allowed.")
+	}
+	if !strings.Contains(err.Error(), "<reader>:1") {
+		t.Fatalf("Error should refer to the reader, got: %s", err.Error())
+	}
+}
+
+func TestRenamedKeys(t *testing.T) {
+	type Config struct {
+		AdminEmail []string `itkconfig:"admin_email"`
+		Port       int      `itkconfig:"listen_port"`
+	}
+
+	config := Config{}
+	err := LoadConfig("test_configs/renamedkeys.cfg", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config with renamed keys: %s", err.Error())
+	}
+
+	want := Config{
+		AdminEmail: []string{"foo@mailinator.com", "bar@mailinator.com"},
+		Port:       8000,
+	}
+	if !reflect.DeepEqual(want, config) {
+		t.Fatalf(`
+Could not parse config with renamed keys.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+}
+
+func TestRenamedKeyFieldName(t *testing.T) {
+	type Config struct {
+		Foo string `itkconfig:"foo"`
+	}
+
+	err := LoadConfig("test_configs/string.cfg", &Config{})
+	if err == nil {
+		t.Fatal("Field name should not be accepted as key when the field is renamed.")
+	}
+}
+
+func TestPointer(t *testing.T) {
+	type Config struct {
+		Port *int
+		Name *string
+	}
+
+	config := Config{}
+	err := LoadConfig("test_configs/pointer.cfg", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config with pointer fields: %s", err.Error())
+	}
+
+	if config.Port == nil || *config.Port != 8000 {
+		t.Fatalf("Config parsed incorrectly. Expected Port to point to %d, got: %#v", 8000, config.Port)
+	}
+	if config.Name != nil {
+		t.Fatalf("Config parsed incorrectly. Expected Name to be nil, got: %#v", config.Name)
+	}
+}
+
+func TestEnvExpansion(t *testing.T) {
+	type Config struct {
+		DatabaseURL string
+		Price       string
+	}
+
+	t.Setenv("ITKCONFIG_TEST_DB_URL", "postgres://localhost/db")
+	config := Config{}
+	err := LoadConfig("test_configs/env.cfg", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config with environment variables: %s", err.Error())
+	}
+
+	want := Config{
+		DatabaseURL: "postgres://localhost/db",
+		Price:       "$5 # not an env var",
+	}
+	if want != config {
+		t.Fatalf(`
+Could not parse config with environment variables correctly.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+}
+
+func TestUnsetEnv(t *testing.T) {
+	type Config struct {
+		DatabaseURL string
+	}
+
+	config := Config{DatabaseURL: "default"}
+	err := LoadConfig("test_configs/unsetenv.cfg", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config with unset environment variable: %s", err.Error())
+	}
+	if config.DatabaseURL != "" {
+		t.Fatalf("Unset environment variable should expand to empty string, got: '%s'", config.DatabaseURL)
+	}
+
+	err = LoadConfigWithOptions("test_configs/unsetenv.cfg", &config, Options{ErrorOnUnsetEnv: true})
+	if err == nil {
+		t.Fatal("Unset environment variable should not be allowed with ErrorOnUnsetEnv.")
+	}
+	if !strings.Contains(err.Error(), "ITKCONFIG_TEST_UNSET") {
+		t.Fatalf("Error should mention the variable, got: %s", err.Error())
+	}
+}
+
+func TestTypedSlices(t *testing.T) {
+	type Config struct {
+		Ports  []int
+		Counts []uint
+		Ratios []float64
+		Flags  []bool
+	}
+
+	config := Config{}
+	err := LoadConfig("test_configs/typedslices.cfg", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config with typed slices: %s", err.Error())
+	}
+
+	want := Config{
+		Ports:  []int{8080, -1},
+		Counts: []uint{1, 2},
+		Ratios: []float64{0.5, 1000},
+		Flags:  []bool{true, false},
+	}
+	if !reflect.DeepEqual(want, config) {
+		t.Fatalf(`
+Could not parse config with typed slices.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+}
+
+func TestInvalidSliceElement(t *testing.T) {
+	type Config struct {
+		Counts []uint
+	}
+
+	err := LoadConfigFromReader(strings.NewReader("Counts = 1\nCounts = one\n"), &Config{})
+	if err == nil {
+		t.Fatal("Invalid slice element should not be allowed.")
+	}
+	if !strings.Contains(err.Error(), "<reader>:2") {
+		t.Fatalf("Error should point at the invalid element, got: %s", err.Error())
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	type Config struct {
+		Port  int       `itkconfig:"default=8000"`
+		Host  string    `itkconfig:"default=localhost"`
+		Debug bool      `itkconfig:"debug,default=true"`
+		Ratio float64   `itkconfig:"default=0.5"`
+		Day   time.Time `itkconfig:"layout=Jan 2, 2006,default=Jan 2, 2023"`
+		Name  string
+	}
+
+	config := Config{}
+	err := LoadConfig("test_configs/defaults.cfg", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config with defaults: %s", err.Error())
+	}
+
+	want := Config{
+		Port:  9000,
+		Host:  "localhost",
+		Debug: true,
+		Ratio: 0.5,
+		Day:   time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC),
+		Name:  "",
+	}
+	if want != config {
+		t.Fatalf(`
+Could not parse config with defaults correctly.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+}
+
+func TestDefaultDoesNotOverridePrepopulated(t *testing.T) {
+	type Config struct {
+		Host string `itkconfig:"default=localhost"`
+	}
+
+	config := Config{Host: "example.org"}
+	err := LoadConfig("test_configs/empty.cfg", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config with defaults: %s", err.Error())
+	}
+	if config.Host != "example.org" {
+		t.Fatalf("Default should not override pre-populated value, got: '%s'", config.Host)
+	}
+}
+
+func TestInvalidDefault(t *testing.T) {
+	type Config struct {
+		Port int `itkconfig:"default=eighty"`
+	}
+
+	err := LoadConfig("test_configs/empty.cfg", &Config{})
+	if err == nil {
+		t.Fatal("Invalid default value should not be allowed.")
+	}
+}
+
+func TestRequired(t *testing.T) {
+	type Config struct {
+		Foo  string `itkconfig:"required"`
+		Port int    `itkconfig:"port,required"`
+		Host string `itkconfig:"required,default=localhost"`
+	}
+
+	err := LoadConfig("test_configs/string.cfg", &Config{})
+	if err == nil {
+		t.Fatal("Missing required keys should not be allowed.")
+	}
+	if !strings.Contains(err.Error(), "'port'") || !strings.Contains(err.Error(), "'Host'") {
+		t.Fatalf("Error should mention every missing key, got: %s", err.Error())
+	}
+	if strings.Contains(err.Error(), "'Foo'") {
+		t.Fatalf("Error should not mention keys that are present, got: %s", err.Error())
+	}
+}
+
+func TestLineContinuation(t *testing.T) {
+	type Config struct {
+		Command string
+		After   int
+	}
+
+	config := Config{}
+	err := LoadConfig("test_configs/continuation.cfg", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config with line continuation: %s", err.Error())
+	}
+
+	want := Config{
+		Command: "/usr/bin/app --verbose --port=8000 --name=itk \"config\"",
+		After:   1,
+	}
+	if want != config {
+		t.Fatalf(`
+Could not parse config with line continuation correctly.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	type Config struct {
+		Foo string
+		Bar int
+	}
+
+	for i, input := range []string{"Foo = one\nBar = 1\n", "Foo = two\nBar = 2\n"} {
+		config := Config{}
+		err := NewDecoder(strings.NewReader(input)).Decode(&config)
+		if err != nil {
+			t.Fatalf("Could not decode config: %s", err.Error())
+		}
+
+		want := []Config{{Foo: "one", Bar: 1}, {Foo: "two", Bar: 2}}[i]
+		if want != config {
+			t.Fatalf(`
+Could not decode config correctly.
+	expected: %#v
+	got:      %#v`, want, config)
+		}
+	}
+}
+
+func TestDecoderOptions(t *testing.T) {
+	type Config struct {
+		DatabaseURL string
+	}
+
+	d := NewDecoder(strings.NewReader("DatabaseURL = ${ITKCONFIG_TEST_UNSET}\n"))
+	d.ErrorOnUnsetEnv = true
+	err := d.Decode(&Config{})
+	if err == nil {
+		t.Fatal("Unset environment variable should not be allowed with ErrorOnUnsetEnv.")
+	}
+}
+
+func TestTextUnmarshaler(t *testing.T) {
+	type Config struct {
+		Level  LogLevel
+		Levels []LogLevel
+	}
+
+	config := Config{}
+	err := LoadConfig("test_configs/textunmarshaler.cfg", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config with TextUnmarshaler: %s", err.Error())
+	}
+
+	want := Config{
+		Level:  LogWarn,
+		Levels: []LogLevel{LogDebug, LogError},
+	}
+	if !reflect.DeepEqual(want, config) {
+		t.Fatalf(`
+Could not parse config with TextUnmarshaler correctly.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+}
+
+func TestInvalidTextUnmarshaler(t *testing.T) {
+	type Config struct {
+		Level LogLevel
+	}
+
+	err := LoadConfigFromReader(strings.NewReader("Level = loud\n"), &Config{})
+	if err == nil {
+		t.Fatal("Value rejected by UnmarshalText should not be allowed.")
+	}
+	if !strings.Contains(err.Error(), "unknown log level") {
+		t.Fatalf("Error should contain the error from UnmarshalText, got: %s", err.Error())
+	}
+}
+
+func TestCommentPrefix(t *testing.T) {
+	type Config struct {
+		Foo int
+		Bar string
+		Baz string
+	}
+
+	config := Config{}
+	err := LoadConfigWithOptions("test_configs/semicoloncomment.cfg", &config, Options{CommentPrefix: ";"})
+	if err != nil {
+		t.Fatalf("Could not parse config with ; comments: %s", err.Error())
+	}
+
+	want := Config{
+		Foo: 1,
+		Bar: "a;b",
+		Baz: "#not a comment",
+	}
+	if want != config {
+		t.Fatalf(`
+Could not parse config with ; comments correctly.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+}
+
+func TestErrorColumn(t *testing.T) {
+	type Config struct {
+		Foo int
+	}
+
+	tests := []struct {
+		input  string
+		column string
+	}{
+		{"  Foo =   bar # comment\n", "<reader>:1:11"},
+		{"\tFoo\n", "<reader>:1:5"},
+		{"Bar = 1\n", "<reader>:1:1"},
+	}
+	for _, test := range tests {
+		err := LoadConfigFromReader(strings.NewReader(test.input), &Config{})
+		if err == nil {
+			t.Fatalf("Parsed invalid config: %q", test.input)
+		}
+		if !strings.Contains(err.Error(), test.column) {
+			t.Fatalf("Error for %q should contain %s, got: %s", test.input, test.column, err.Error())
+		}
+	}
+}
+
+type ValidatedConfig struct {
+	Port int
+}
+
+var errInvalidPort = errors.New("port must be between 1 and 65535")
+
+func (c *ValidatedConfig) Validate() error {
+	if c.Port < 1 || c.Port > 65535 {
+		return errInvalidPort
+	}
+	return nil
+}
+
+func TestValidator(t *testing.T) {
+	config := ValidatedConfig{}
+	err := LoadConfigString("Port = 8000", &config)
+	if err != nil {
+		t.Fatalf("Valid config should pass validation: %s", err.Error())
+	}
+
+	err = LoadConfigString("Port = 70000", &config)
+	if !errors.Is(err, errInvalidPort) {
+		t.Fatalf("Error from Validate should be returned, got: %v", err)
+	}
+}
+
+func TestLoadConfigString(t *testing.T) {
+	type Config struct {
+		Port  int
+		Debug bool
+	}
+
+	config := Config{}
+	err := LoadConfigString(`
+# Port that the webservice is listening to
+Port = 8000
+Debug = true
+`, &config)
+	if err != nil {
+		t.Fatalf("Could not parse config from string: %s", err.Error())
+	}
+
+	want := Config{
+		Port:  8000,
+		Debug: true,
+	}
+	if want != config {
+		t.Fatalf(`
+Could not parse config from string.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+
+	err = LoadConfigString("Port = eighty", &config)
+	if err == nil || !strings.Contains(err.Error(), "<string>:1") {
+		t.Fatalf("Error should refer to the string, got: %v", err)
+	}
+}
+
+func TestStrictSliceContiguity(t *testing.T) {
+	type Config struct {
+		Foo []string
+		Bar int
+	}
+
+	opts := Options{StrictSliceContiguity: true}
+	config := Config{}
+	err := LoadConfigWithOptions("test_configs/contiguousslice.cfg", &config, opts)
+	if err != nil {
+		t.Fatalf("Could not parse config with contiguous slice: %s", err.Error())
+	}
+	want := []string{"a", "b", "c"}
+	if !reflect.DeepEqual(want, config.Foo) {
+		t.Fatalf("Config parsed incorrectly. Expected: %#v, got: %#v", want, config.Foo)
+	}
+
+	err = LoadConfigWithOptions("test_configs/interleavedslice.cfg", &Config{}, opts)
+	if err == nil {
+		t.Fatal("Interleaved slice definitions should not be allowed with StrictSliceContiguity.")
+	}
+
+	err = LoadConfig("test_configs/interleavedslice.cfg", &Config{})
+	if err != nil {
+		t.Fatalf("Interleaved slice definitions should be allowed by default: %s", err.Error())
+	}
+}
+
+type BaseConfig struct {
+	LogLevel string
+	Tags     []string
+}
+
+type ExtraConfig struct {
+	Timeout int
+}
+
+func TestEmbeddedStruct(t *testing.T) {
+	type Config struct {
+		BaseConfig
+		*ExtraConfig
+		Port int
+	}
+
+	config := Config{}
+	err := LoadConfig("test_configs/embedded.cfg", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config with embedded structs: %s", err.Error())
+	}
+
+	want := Config{
+		BaseConfig: BaseConfig{
+			LogLevel: "debug",
+			Tags:     []string{"a", "b"},
+		},
+		ExtraConfig: &ExtraConfig{Timeout: 5},
+		Port:        8000,
+	}
+	if !reflect.DeepEqual(want, config) {
+		t.Fatalf(`
+Could not parse config with embedded structs correctly.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+}
+
+func TestEmbeddedStructKey(t *testing.T) {
+	type Config struct {
+		BaseConfig
+	}
+
+	err := LoadConfigString("BaseConfig = foo", &Config{})
+	if err == nil {
+		t.Fatal("Embedded struct should not be settable as a key.")
+	}
+}
+
+func TestBounds(t *testing.T) {
+	type Config struct {
+		Port  int     `itkconfig:"min=1,max=65535"`
+		Count uint8   `itkconfig:"max=10"`
+		Ratio float64 `itkconfig:"min=0,max=1"`
+	}
+
+	config := Config{}
+	err := LoadConfigString("Port = 8000\nCount = 10\nRatio = 0.5\n", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config with values within bounds: %s", err.Error())
+	}
+	want := Config{Port: 8000, Count: 10, Ratio: 0.5}
+	if want != config {
+		t.Fatalf(`
+Could not parse config with values within bounds correctly.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+
+	tests := []struct {
+		input   string
+		message string
+	}{
+		{"Port = 0", `value 0 in key "Port" is below the minimum of 1`},
+		{"Port = 65536", `value 65536 in key "Port" is above the maximum of 65535`},
+		{"Count = 11", `value 11 in key "Count" is above the maximum of 10`},
+		{"Ratio = -0.5", `value -0.5 in key "Ratio" is below the minimum of 0`},
+	}
+	for _, test := range tests {
+		err := LoadConfigString(test.input, &Config{})
+		if err == nil {
+			t.Fatalf("Value out of bounds should not be allowed: %s", test.input)
+		}
+		if !strings.Contains(err.Error(), test.message) {
+			t.Fatalf("Error for %q should contain %q, got: %s", test.input, test.message, err.Error())
+		}
+	}
+}
+
+func TestBytes(t *testing.T) {
+	type Config struct {
+		SigningKey []byte
+		Password   []byte `itkconfig:"raw"`
+	}
+
+	config := Config{}
+	err := LoadConfig("test_configs/bytes.cfg", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config with byte slices: %s", err.Error())
+	}
+
+	want := Config{
+		SigningKey: []byte("hello"),
+		Password:   []byte("s3cr3t # with hash"),
+	}
+	if !reflect.DeepEqual(want, config) {
+		t.Fatalf(`
+Could not parse config with byte slices correctly.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+
+	err = LoadConfigString("SigningKey = not base64!", &config)
+	if err == nil {
+		t.Fatal("Invalid base64 should not be allowed.")
+	}
+}
+
+func TestEscapedEquals(t *testing.T) {
+	type Config struct {
+		Page  string `itkconfig:"/path?page=1"`
+		Plain string
+	}
+
+	config := Config{}
+	err := LoadConfig("test_configs/escapedequals.cfg", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config with escaped equals sign: %s", err.Error())
+	}
+
+	want := Config{
+		Page:  "index=2",
+		Plain: "a=b",
+	}
+	if want != config {
+		t.Fatalf(`
+Could not parse config with escaped equals sign correctly.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+}
+
+func TestIP(t *testing.T) {
+	type Config struct {
+		BindAddr    net.IP
+		AllowedCIDR net.IPNet
+		Peers       []net.IP
+	}
+
+	config := Config{}
+	err := LoadConfig("test_configs/net.cfg", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config with IP addresses: %s", err.Error())
+	}
+
+	if !config.BindAddr.Equal(net.IPv4(192, 168, 1, 1)) {
+		t.Fatalf("Config parsed incorrectly. Expected BindAddr: 192.168.1.1, got: %s", config.BindAddr)
+	}
+	if config.AllowedCIDR.String() != "10.0.0.0/8" {
+		t.Fatalf("Config parsed incorrectly. Expected AllowedCIDR: 10.0.0.0/8, got: %s", config.AllowedCIDR.String())
+	}
+	if len(config.Peers) != 2 || !config.Peers[0].Equal(net.IPv6loopback) || !config.Peers[1].Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("Config parsed incorrectly. Expected Peers: [::1 127.0.0.1], got: %s", config.Peers)
+	}
+}
+
+func TestInvalidIP(t *testing.T) {
+	type Config struct {
+		BindAddr    net.IP
+		AllowedCIDR net.IPNet
+	}
+
+	err := LoadConfigString("BindAddr = 192.168.1.256", &Config{})
+	if err == nil {
+		t.Fatal("Invalid IP address should not be allowed.")
+	}
+
+	err = LoadConfigString("AllowedCIDR = 10.0.0.0/33", &Config{})
+	if err == nil {
+		t.Fatal("Invalid CIDR should not be allowed.")
+	}
+}
+
+func TestURL(t *testing.T) {
+	type Config struct {
+		Endpoint url.URL
+		Fallback *url.URL
+	}
+
+	config := Config{}
+	err := LoadConfig("test_configs/url.cfg", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config with URLs: %s", err.Error())
+	}
+
+	if config.Endpoint.Scheme != "https" || config.Endpoint.Host != "api.example.com" || config.Endpoint.Path != "/v1" {
+		t.Fatalf("Config parsed incorrectly. Expected Endpoint: https://api.example.com/v1, got: %#v", config.Endpoint)
+	}
+	if config.Fallback == nil || config.Fallback.Host != "backup.example.com" || config.Fallback.Fragment != "top" {
+		t.Fatalf("Config parsed incorrectly. Expected Fallback: http://backup.example.com/v2?a=b#top, got: %#v", config.Fallback)
+	}
+}
+
+func TestInvalidURL(t *testing.T) {
+	type Config struct {
+		Endpoint url.URL
+	}
+
+	err := LoadConfigString("Endpoint = http://[::1", &Config{})
+	if err == nil {
+		t.Fatal("Invalid URL should not be allowed.")
+	}
+}
+
+func TestCRLF(t *testing.T) {
+	type Config struct {
+		Foo string
+		Bar int
+		Baz string
+		Qux string
+	}
+
+	config := Config{}
+	err := LoadConfig("test_configs/crlf.cfg", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config with CRLF line endings: %s", err.Error())
+	}
+
+	want := Config{
+		Foo: "  bar  ",
+		Bar: 1,
+		Baz: "one two",
+		Qux: "last",
+	}
+	if want != config {
+		t.Fatalf(`
+Could not parse config with CRLF line endings correctly.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+}
+
+func TestNegativeUint(t *testing.T) {
+	type Config struct {
+		Count uint
+	}
+
+	err := LoadConfigString("Count = -5", &Config{})
+	if err == nil {
+		t.Fatal("Negative value for uint should not be allowed.")
+	}
+	want := `key "Count" expects a non-negative integer but got "-5"`
+	if !strings.Contains(err.Error(), want) {
+		t.Fatalf("Error should contain %q, got: %s", want, err.Error())
+	}
+}
+
+func TestIntPrefixes(t *testing.T) {
+	type Config struct {
+		Flags    uint8
+		Mode     int
+		Mask     int
+		Negative int
+		Decimal  int
+	}
+
+	config := Config{}
+	err := LoadConfig("test_configs/intprefix.cfg", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config with prefixed integers: %s", err.Error())
+	}
+
+	want := Config{
+		Flags:    0xFF,
+		Mode:     0o755,
+		Mask:     0b1010,
+		Negative: -0x10,
+		Decimal:  10,
+	}
+	if want != config {
+		t.Fatalf(`
+Could not parse config with prefixed integers correctly.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+}
+
+func TestByteSize(t *testing.T) {
+	type Config struct {
+		MaxUpload  int64  `itkconfig:"bytes"`
+		ChunkSize  uint32 `itkconfig:"bytes"`
+		BufferSize int    `itkconfig:"bytes"`
+		CacheSize  uint64 `itkconfig:"bytes"`
+	}
+
+	config := Config{}
+	err := LoadConfig("test_configs/bytesize.cfg", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config with byte sizes: %s", err.Error())
+	}
+
+	want := Config{
+		MaxUpload:  10000000,
+		ChunkSize:  512 * 1024,
+		BufferSize: 4096,
+		CacheSize:  2 << 30,
+	}
+	if want != config {
+		t.Fatalf(`
+Could not parse config with byte sizes correctly.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+}
+
+func TestInvalidByteSize(t *testing.T) {
+	type Config struct {
+		MaxUpload uint8 `itkconfig:"bytes"`
+		Plain     int
+	}
+
+	for _, input := range []string{"MaxUpload = 10 parsecs", "MaxUpload = 1KB", "MaxUpload = MB", "Plain = 10MB"} {
+		err := LoadConfigString(input, &Config{})
+		if err == nil {
+			t.Fatalf("Invalid byte size should not be allowed: %s", input)
+		}
+	}
+}
+
+func TestMultilineValue(t *testing.T) {
+	type Config struct {
+		Certificate string
+		Message     string
+		Single      string
+		Quoted      string
+	}
+
+	config := Config{}
+	err := LoadConfig("test_configs/multiline.cfg", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config with multi-line values: %s", err.Error())
+	}
+
+	want := Config{
+		Certificate: "-----BEGIN CERTIFICATE-----\n  MIIBszCCAVmgAwIBAgIUX # not a comment \"quoted\"\n-----END CERTIFICATE-----",
+		Message:     "first line\nsecond line\nthird line",
+		Single:      "on one line",
+		Quoted:      "still a single line",
+	}
+	if want != config {
+		t.Fatalf(`
+Could not parse config with multi-line values correctly.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+}
+
+func TestUnterminatedMultilineValue(t *testing.T) {
+	type Config struct {
+		Message string
+	}
+
+	err := LoadConfigString("Message = \"\"\"first line\nsecond line\n", &Config{})
+	if err == nil {
+		t.Fatal("Multi-line value without closing delimiter should not be allowed.")
+	}
+
+	err = LoadConfigString("Message = \"\"\"first\nsecond\"\"\" trailing\n", &Config{})
+	if err == nil {
+		t.Fatal("Text after closing delimiter should not be allowed.")
+	}
+}
+
+func TestAllowUnknownKeys(t *testing.T) {
+	type Config struct {
+		Port int
+	}
+
+	config := Config{}
+	err := LoadConfigWithOptions("test_configs/unknownkeys.cfg", &config, Options{AllowUnknownKeys: true})
+	if err != nil {
+		t.Fatalf("Could not parse config with unknown keys: %s", err.Error())
+	}
+	if config.Port != 8000 {
+		t.Fatalf("Config parsed incorrectly. Expected: %d, got: %d", 8000, config.Port)
+	}
+
+	err = LoadConfig("test_configs/unknownkeys.cfg", &Config{})
+	if err == nil {
+		t.Fatal("Unknown keys should not be allowed by default.")
+	}
+}
+
+func TestBoolWords(t *testing.T) {
+	type Config struct {
+		Enabled bool
+		Feature bool
+		Verbose bool
+		Quiet   bool
+		Legacy  bool
+	}
+
+	config := Config{Feature: true, Quiet: true}
+	err := LoadConfig("test_configs/boolwords.cfg", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config with yes/no/on/off: %s", err.Error())
+	}
+
+	want := Config{
+		Enabled: true,
+		Feature: false,
+		Verbose: true,
+		Quiet:   false,
+		Legacy:  true,
+	}
+	if want != config {
+		t.Fatalf(`
+Could not parse config with yes/no/on/off correctly.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+}
+
+func TestInvalidBool(t *testing.T) {
+	type Config struct {
+		Enabled bool
+	}
+
+	err := LoadConfigString("Enabled = maybe", &Config{})
+	if err == nil {
+		t.Fatal("Invalid bool should not be allowed.")
+	}
+	if !strings.Contains(err.Error(), "yes, on") {
+		t.Fatalf("Error should list the accepted values, got: %s", err.Error())
+	}
+}
+
+func TestChar(t *testing.T) {
+	type Config struct {
+		Delimiter rune `itkconfig:"char"`
+		Quote     rune `itkconfig:"char"`
+		Separator rune `itkconfig:"char"`
+		Arrow     rune `itkconfig:"char"`
+		Code      rune
+	}
+
+	config := Config{}
+	err := LoadConfig("test_configs/char.cfg", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config with characters: %s", err.Error())
+	}
+
+	want := Config{
+		Delimiter: ',',
+		Quote:     '"',
+		Separator: ' ',
+		Arrow:     '→',
+		Code:      44,
+	}
+	if want != config {
+		t.Fatalf(`
+Could not parse config with characters correctly.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+
+	err = LoadConfigString("Delimiter = ab", &config)
+	if err == nil {
+		t.Fatal("More than one character should not be allowed.")
+	}
+}
+
+func TestWalk(t *testing.T) {
+	type entry struct {
+		Key   string
+		Value string
+		Line  uint
+	}
+
+	f, err := os.Open("test_configs/walk.cfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var got []entry
+	err = Walk(f, func(key, value string, line uint) error {
+		got = append(got, entry{key, value, line})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Could not walk config: %s", err.Error())
+	}
+
+	want := []entry{
+		{"Name", "My app", 2},
+		{"Admin", "foo@example.com", 3},
+		{"Admin", "bar@example.com", 5},
+		{"Command", "/usr/bin/app --verbose", 6},
+		{"Home", "${HOME}", 8},
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf(`
+Could not walk config.
+	expected: %#v
+	got:      %#v`, want, got)
+	}
+}
+
+func TestWalkStops(t *testing.T) {
+	errStop := errors.New("stop")
+	calls := 0
+	err := Walk(strings.NewReader("Foo = 1\nBar = 2\n"), func(key, value string, line uint) error {
+		calls++
+		return errStop
+	})
+	if !errors.Is(err, errStop) {
+		t.Fatalf("Walk should return the error of fn, got: %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("Walk should stop after fn returns an error, but called it %d times", calls)
+	}
+}
+
+func TestInlineList(t *testing.T) {
+	type Config struct {
+		AdminEmail []string
+		Ports      []int
+	}
+
+	config := Config{}
+	err := LoadConfig("test_configs/inlinelist.cfg", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config with inline lists: %s", err.Error())
+	}
+
+	want := Config{
+		AdminEmail: []string{"a@example.com", "b@example.com", "Doe, Jane <c@example.com>"},
+		Ports:      []int{80, 443},
+	}
+	if !reflect.DeepEqual(want, config) {
+		t.Fatalf(`
+Could not parse inline lists.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+}
+
+func TestInvalidInlineList(t *testing.T) {
+	type Config struct {
+		Foo []string
+	}
+
+	for _, s := range []string{"Foo = [a, b", "Foo = [a, b] c"} {
+		err := LoadConfigString(s, &Config{})
+		if err == nil {
+			t.Fatalf("Invalid inline list should not be allowed: %s", s)
+		}
+	}
+
+	config := Config{}
+	err := LoadConfigString(`Foo = "[a, b]"`, &config)
+	if err != nil {
+		t.Fatalf("Could not parse quoted value starting with [: %s", err.Error())
+	}
+	if want := []string{"[a, b]"}; !reflect.DeepEqual(want, config.Foo) {
+		t.Fatalf(`
+A quoted value should not be parsed as an inline list.
+	expected: %#v
+	got:      %#v`, want, config.Foo)
+	}
+}
+
+func TestSliceMergeMode(t *testing.T) {
+	type Config struct {
+		Tags []string
+	}
+
+	tests := []struct {
+		mode SliceMergeMode
+		want []string
+	}{
+		{SliceReplace, []string{"override"}},
+		{SliceAppend, []string{"base", "common", "override"}},
+	}
+	for _, test := range tests {
+		config := Config{}
+		opts := Options{SliceMergeMode: test.mode}
+		for _, filename := range []string{"test_configs/slicebase.cfg", "test_configs/sliceoverride.cfg"} {
+			err := LoadConfigWithOptions(filename, &config, opts)
+			if err != nil {
+				t.Fatalf("Could not parse %s: %s", filename, err.Error())
+			}
+		}
+
+		if !reflect.DeepEqual(test.want, config.Tags) {
+			t.Fatalf(`
+Slices were not merged according to mode %d.
+	expected: %#v
+	got:      %#v`, test.mode, test.want, config.Tags)
+		}
+	}
+}
+
+func TestRaw(t *testing.T) {
+	type Config struct {
+		Query Raw
+		Plain string
+	}
+
+	config := Config{}
+	err := LoadConfig("test_configs/raw.cfg", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config with raw value: %s", err.Error())
+	}
+
+	want := Config{
+		Query: `{"name": "#1", "tags": ["a", "b"]} # kept as well`,
+		Plain: "#1",
+	}
+	if !reflect.DeepEqual(want, config) {
+		t.Fatalf(`
+Raw value was not stored verbatim.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+}
+
+func TestByteOrderMark(t *testing.T) {
+	type Config struct {
+		Name string
+		Port int
+	}
+
+	config := Config{}
+	err := LoadConfig("test_configs/bom.cfg", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config starting with a byte order mark: %s", err.Error())
+	}
+
+	want := Config{Name: "bom", Port: 80}
+	if want != config {
+		t.Fatalf(`
+Could not parse config starting with a byte order mark.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+}
+
+func TestTrailingBackslash(t *testing.T) {
+	type Config struct {
+		Dir string
+		X   string
+	}
+
+	for _, s := range []string{
+		"Dir = C:\\",
+		"Dir = C:\\ # drive\n",
+		"Dir = C:\\\\\nX = y\n",
+		"Dir = \"C:\\\\\"\nX = y\n",
+	} {
+		config := Config{}
+		err := LoadConfigString(s, &config)
+		if err != nil {
+			t.Fatalf("Could not parse value ending with a backslash %q: %s", s, err.Error())
+		}
+		if config.Dir != "C:\\" {
+			t.Fatalf(`
+Could not parse value ending with a backslash.
+	expected: %#v
+	got:      %#v`, "C:\\", config.Dir)
+		}
+		if strings.Contains(s, "X = y") && config.X != "y" {
+			t.Fatalf("Line after value ending with a backslash was joined with it: %#v", config)
+		}
+	}
+}
+
+func TestBackslashInComment(t *testing.T) {
+	type Config struct {
+		Path string
+		Port int
+	}
+
+	config := Config{}
+	err := LoadConfigString("Path = /x # C:\\\nPort = 80\n", &config)
+	if err != nil {
+		t.Fatalf("Could not parse comment ending with a backslash: %s", err.Error())
+	}
+	want := Config{Path: "/x", Port: 80}
+	if config != want {
+		t.Fatalf(`
+Line after comment ending with a backslash was joined with it.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+}
+
+func TestLoadConfigMap(t *testing.T) {
+	config := map[string]string{}
+	err := LoadConfig("test_configs/map.cfg", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config into map: %s", err.Error())
+	}
+
+	want := map[string]string{
+		"Name":     "My app",
+		"Port":     "8000",
+		"Greeting": "Hello, world",
+	}
+	if !reflect.DeepEqual(want, config) {
+		t.Fatalf(`
+Could not parse config into map.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+
+	var iface map[string]interface{}
+	err = LoadConfig("test_configs/map.cfg", &iface)
+	if err != nil {
+		t.Fatalf("Could not parse config into interface map: %s", err.Error())
+	}
+	if iface["Port"] != "8000" {
+		t.Fatalf("Interface map should hold the value as a string, got: %#v", iface["Port"])
+	}
+
+	err = LoadConfigString("Foo = 1\nFoo = 2\n", &config)
+	if err == nil {
+		t.Fatal("Repeated keys in a map config should not be allowed.")
+	}
+}
+
+func TestKeyCollision(t *testing.T) {
+	type Config struct {
+		Port       int
+		ListenPort int `itkconfig:"port"`
+	}
+
+	err := LoadConfigString("Port = 80\n", &Config{})
+	if err == nil {
+		t.Fatal("Fields with colliding keys should not be allowed.")
+	}
+	if !strings.Contains(err.Error(), "collides") {
+		t.Fatalf("Error should report the collision, got: %s", err.Error())
+	}
+
+	type DuplicateConfig struct {
+		Host    string
+		Address string `itkconfig:"Host"`
+	}
+
+	_, err = Marshal(DuplicateConfig{})
+	if err == nil {
+		t.Fatal("Fields with duplicate keys should not be marshaled.")
+	}
+
+	// Unexported fields can not be set, so they do not collide with the
+	// exported ones.
+	type UnexportedConfig struct {
+		Name string
+		name string
+	}
+
+	config := UnexportedConfig{}
+	err = LoadConfigString("Name = foo\n", &config)
+	if err != nil {
+		t.Fatalf("Unexported field should not collide with exported field: %s", err.Error())
+	}
+	if config.Name != "foo" {
+		t.Fatalf("Exported field was not set: %#v", config)
+	}
+
+	config = UnexportedConfig{}
+	d := NewDecoder(strings.NewReader("name = foo\n"))
+	d.KeyStyle = LowerCase
+	err = d.Decode(&config)
+	if err != nil {
+		t.Fatalf("Unexported field should not collide with exported field: %s", err.Error())
+	}
+	if config.Name != "foo" {
+		t.Fatalf("Exported field was not set: %#v", config)
+	}
+}
+
+func TestSliceDefaults(t *testing.T) {
+	type Config struct {
+		Tags  []string `itkconfig:"default=a, b,c"`
+		Ports []int    `itkconfig:"default=8000,8080"`
+	}
+
+	config := Config{}
+	err := LoadConfig("test_configs/slicedefaults.cfg", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config with slice defaults: %s", err.Error())
+	}
+
+	want := Config{
+		Tags:  []string{"a", "b", "c"},
+		Ports: []int{80, 443},
+	}
+	if !reflect.DeepEqual(want, config) {
+		t.Fatalf(`
+Could not parse config with slice defaults correctly.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+}
+
+// cancelingReader returns one line per read, and cancels its context when the
+// given line is read.
+type cancelingReader struct {
+	lines    []string
+	cancelAt int
+	cancel   context.CancelFunc
+}
+
+func (r *cancelingReader) Read(p []byte) (int, error) {
+	if len(r.lines) == 0 {
+		return 0, io.EOF
+	}
+	if r.cancelAt--; r.cancelAt == 0 {
+		r.cancel()
+	}
+	n := copy(p, r.lines[0])
+	r.lines = r.lines[1:]
+	return n, nil
+}
+
+func TestLoadConfigContext(t *testing.T) {
+	type Config struct {
+		Foo int
+		Bar int
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := &cancelingReader{
+		lines:    []string{"Foo = 1\n", "Bar = 2\n"},
+		cancelAt: 2,
+		cancel:   cancel,
+	}
+
+	config := Config{}
+	err := LoadConfigContext(ctx, r, &config)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Loading should stop when the context is canceled, got: %v", err)
+	}
+	if want := (Config{Foo: 1}); want != config {
+		t.Fatalf(`
+Keys before the cancellation should be set.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+}
+
+func TestOverflow(t *testing.T) {
+	type Config struct {
+		Small int8
+		Byte  uint8
+		Ratio float32
+	}
+
+	tests := []struct {
+		config string
+		want   string
+	}{
+		{"Small = 99999", `key "Small" value 99999 overflows int8`},
+		{"Small = -129", `key "Small" value -129 overflows int8`},
+		{"Byte = 256", `key "Byte" value 256 overflows uint8`},
+		{"Ratio = 1e39", `key "Ratio" value 1e39 overflows float32`},
+	}
+	for _, test := range tests {
+		err := LoadConfigString(test.config, &Config{})
+		if err == nil {
+			t.Fatalf("Overflowing value should not be allowed: %s", test.config)
+		}
+		if !strings.Contains(err.Error(), test.want) {
+			t.Fatalf(`
+Wrong overflow error.
+	expected: %s
+	got:      %s`, test.want, err.Error())
+		}
+	}
+}
+
+func TestSlashCommentPrefix(t *testing.T) {
+	type Config struct {
+		Name   string
+		URL    string
+		Quoted string
+	}
+
+	config := Config{}
+	err := LoadConfigWithOptions("test_configs/slashcomment.cfg", &config, Options{CommentPrefix: "//"})
+	if err != nil {
+		t.Fatalf("Could not parse config with // comments: %s", err.Error())
+	}
+
+	want := Config{
+		Name:   "foo",
+		URL:    "http://example.com/path",
+		Quoted: "a // b",
+	}
+	if want != config {
+		t.Fatalf(`
+Could not parse config with // comments correctly.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+}
+
+// hostList implements flag.Value, collecting a host for every call to Set.
+type hostList []string
+
+func (h *hostList) String() string {
+	return strings.Join(*h, ",")
+}
+
+func (h *hostList) Set(value string) error {
+	if value == "" {
+		return errors.New("empty host")
+	}
+	*h = append(*h, value)
+	return nil
+}
+
+func TestFlagValue(t *testing.T) {
+	type Config struct {
+		Hosts hostList
+	}
+
+	config := Config{}
+	err := LoadConfigString("Hosts = a.example.com\nHosts = b.example.com\n", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config with flag.Value: %s", err.Error())
+	}
+
+	want := hostList{"a.example.com", "b.example.com"}
+	if !reflect.DeepEqual(want, config.Hosts) {
+		t.Fatalf(`
+Could not parse config with flag.Value.
+	expected: %#v
+	got:      %#v`, want, config.Hosts)
+	}
+
+	err = LoadConfigString("Hosts = \"\"\n", &config)
+	var typeErr *TypeError
+	if !errors.As(err, &typeErr) {
+		t.Fatalf("Error from Set should be a TypeError, got: %v", err)
+	}
+}
+
+func TestErrorLineText(t *testing.T) {
+	type Config struct {
+		Port int
+	}
+
+	err := LoadConfigString("  Port = \"80\"x # the port\n", &Config{})
+	if err == nil {
+		t.Fatal("Invalid int should not be allowed.")
+	}
+	if want := `in "  Port = \"80\"x # the port"`; !strings.Contains(err.Error(), want) {
+		t.Fatalf(`
+Error should contain the line as written.
+	expected: %s
+	got:      %s`, want, err.Error())
+	}
+
+	long := "Port = " + strings.Repeat("9", 100)
+	err = LoadConfigString(long, &Config{})
+	if err == nil {
+		t.Fatal("Invalid int should not be allowed.")
+	}
+	if want := `in "` + long[:80] + `..."`; !strings.Contains(err.Error(), want) {
+		t.Fatalf(`
+Error should contain the truncated line.
+	expected: %s
+	got:      %s`, want, err.Error())
+	}
+}
+
+func TestDuration(t *testing.T) {
+	type Config struct {
+		Timeout time.Duration `itkconfig:"max=5m"`
+		Backoff []time.Duration
+	}
+
+	config := Config{}
+	err := LoadConfig("test_configs/duration.cfg", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config with durations: %s", err.Error())
+	}
+
+	want := Config{
+		Timeout: 90 * time.Second,
+		Backoff: []time.Duration{time.Second, 2 * time.Second, 4 * time.Second},
+	}
+	if !reflect.DeepEqual(want, config) {
+		t.Fatalf(`
+Could not parse config with durations.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+
+	err = LoadConfigString("Timeout = 10m", &Config{})
+	if err == nil || !strings.Contains(err.Error(), "above the maximum of 5m") {
+		t.Fatalf("Duration above the maximum should not be allowed, got: %v", err)
+	}
+	err = LoadConfigString("Timeout = 10", &Config{})
+	if err == nil {
+		t.Fatal("Duration without a unit should not be allowed.")
+	}
+}
+
+func TestKeyPrefix(t *testing.T) {
+	type Config struct {
+		Port int
+		Name string
+	}
+
+	config := Config{}
+	err := LoadConfigWithOptions("test_configs/keyprefix.cfg", &config, Options{KeyPrefix: "myapp_"})
+	if err != nil {
+		t.Fatalf("Could not parse config with key prefix: %s", err.Error())
+	}
+
+	want := Config{Port: 8000, Name: "web"}
+	if want != config {
+		t.Fatalf(`
+Could not parse config with key prefix.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+
+	// The prefix is on the name of a section, not on its keys.
+	type Database struct {
+		Host string
+	}
+	type SectionConfig struct {
+		Database Database `itkconfig:"database"`
+	}
+
+	sectionConfig := SectionConfig{}
+	d := NewDecoder(strings.NewReader("[otherapp_database]\nHost = other\nPort = 1\n[myapp_database]\nHost = db.example.com\n"))
+	d.KeyPrefix = "myapp_"
+	if err := d.Decode(&sectionConfig); err != nil {
+		t.Fatalf("Could not parse sections with key prefix: %s", err.Error())
+	}
+	if sectionConfig.Database.Host != "db.example.com" {
+		t.Fatalf(`
+Could not parse section with key prefix.
+	expected: %#v
+	got:      %#v`, "db.example.com", sectionConfig.Database.Host)
+	}
+}
+
+func TestFileMode(t *testing.T) {
+	type Config struct {
+		Umask    os.FileMode
+		DirPerm  os.FileMode
+		FilePerm os.FileMode
+	}
+
+	config := Config{}
+	err := LoadConfig("test_configs/filemode.cfg", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config with file modes: %s", err.Error())
+	}
+
+	want := Config{Umask: 022, DirPerm: 0755, FilePerm: 0640}
+	if want != config {
+		t.Fatalf(`
+Could not parse config with file modes.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+
+	for _, s := range []string{"Umask = 0789", "Umask = 01777"} {
+		err := LoadConfigString(s, &Config{})
+		var typeErr *TypeError
+		if !errors.As(err, &typeErr) {
+			t.Fatalf("Invalid file mode should give a TypeError: %s, got: %v", s, err)
+		}
+	}
+}
+
+func TestRejectEmptyValues(t *testing.T) {
+	type Config struct {
+		Name string
+		Tags []string
+	}
+
+	err := LoadConfigWithOptions("test_configs/emptyvalue.cfg", &Config{}, Options{RejectEmptyValues: true})
+	if err == nil || !strings.Contains(err.Error(), "key 'Name' can not have an empty value") {
+		t.Fatalf("Empty value should not be allowed with RejectEmptyValues, got: %v", err)
+	}
+
+	config := Config{}
+	err = LoadConfig("test_configs/emptyvalue.cfg", &config)
+	if err != nil {
+		t.Fatalf("Empty value should be allowed by default: %s", err.Error())
+	}
+
+	type TaggedConfig struct {
+		Name string `itkconfig:"nonempty"`
+	}
+	err = LoadConfigString("Name = \"\"", &TaggedConfig{})
+	if err == nil {
+		t.Fatal("Empty value should not be allowed for a nonempty field.")
+	}
+}
+
+func TestInterfaceInference(t *testing.T) {
+	type Config struct {
+		Enabled interface{}
+		Retries interface{}
+		Ratio   interface{}
+		Name    interface{}
+		Mode    interface{}
+	}
+
+	config := Config{}
+	err := LoadConfig("test_configs/infer.cfg", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config into interface fields: %s", err.Error())
+	}
+
+	want := Config{
+		Enabled: true,
+		Retries: 3,
+		Ratio:   0.25,
+		Name:    "web",
+		Mode:    "NaN",
+	}
+	if want != config {
+		t.Fatalf(`
+Could not infer the types of interface fields.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+}
+
+func TestInlineListTrailingComma(t *testing.T) {
+	type Config struct {
+		Plain  []string
+		Quoted []string
+	}
+
+	config := Config{}
+	err := LoadConfigString("Plain = [a, b, c,]\nQuoted = [\"a, b\", \"c\", ]\n", &config)
+	if err != nil {
+		t.Fatalf("Could not parse inline lists with trailing commas: %s", err.Error())
+	}
+
+	want := Config{
+		Plain:  []string{"a", "b", "c"},
+		Quoted: []string{"a, b", "c"},
+	}
+	if !reflect.DeepEqual(want, config) {
+		t.Fatalf(`
+Trailing comma should not add an element.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+}
+
+func TestLoadConfigFS(t *testing.T) {
+	type Config struct {
+		Port int
+		Name string
+	}
+
+	fsys := fstest.MapFS{
+		"config/app.cfg": &fstest.MapFile{Data: []byte("Port = 8000\nName = web\n")},
+		"config/bad.cfg": &fstest.MapFile{Data: []byte("Port = eighty\n")},
+	}
+
+	config := Config{}
+	err := LoadConfigFS(fsys, "config/app.cfg", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config from fs.FS: %s", err.Error())
+	}
+	if want := (Config{Port: 8000, Name: "web"}); want != config {
+		t.Fatalf(`
+Could not parse config from fs.FS.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+
+	err = LoadConfigFS(fsys, "config/bad.cfg", &Config{})
+	if err == nil || !strings.Contains(err.Error(), "config/bad.cfg:1") {
+		t.Fatalf("Error should refer to the file name, got: %v", err)
+	}
+
+	err = LoadConfigFS(fsys, "config/missing.cfg", &Config{})
+	if err == nil {
+		t.Fatal("Missing file should give an error.")
+	}
+}
+
+func TestQuotedWhitespace(t *testing.T) {
+	type Config struct {
+		Quoted    string
+		Unquoted  string
+		Commented string
+		Blank     string
+	}
+
+	config := Config{}
+	err := LoadConfig("test_configs/quotedspace.cfg", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config with quoted white space: %s", err.Error())
+	}
+
+	want := Config{
+		Quoted:    "  x  ",
+		Unquoted:  "x",
+		Commented: "  x  ",
+		Blank:     "   ",
+	}
+	if want != config {
+		t.Fatalf(`
+White space should be kept inside quotes and trimmed outside them.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+
+	type NumericConfig struct {
+		Port int
+	}
+	err = LoadConfigString(`Port = "   "`, &NumericConfig{})
+	var typeErr *TypeError
+	if !errors.As(err, &typeErr) || typeErr.Value != "   " {
+		t.Fatalf("Quoted white space should be kept in the TypeError, got: %v", err)
+	}
+}
+
+func TestDisableComments(t *testing.T) {
+	type Config struct {
+		Channel string `itkconfig:"#channel"`
+		Color   string
+	}
+
+	config := Config{}
+	err := LoadConfigWithOptions("test_configs/nocomments.cfg", &config, Options{DisableComments: true})
+	if err != nil {
+		t.Fatalf("Could not parse config without comments: %s", err.Error())
+	}
+
+	want := Config{
+		Channel: "general",
+		Color:   "#ff0000 # not a comment either",
+	}
+	if want != config {
+		t.Fatalf(`
+Could not parse config without comments.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+}
+
+func TestDigitSeparators(t *testing.T) {
+	type Config struct {
+		MaxRows int
+		Limit   uint16
+		Pi      float64
+	}
+
+	config := Config{}
+	err := LoadConfig("test_configs/underscores.cfg", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config with digit separators: %s", err.Error())
+	}
+
+	want := Config{MaxRows: 1000000, Limit: 0xFFFF, Pi: 3.1415}
+	if want != config {
+		t.Fatalf(`
+Could not parse config with digit separators.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+
+	for _, s := range []string{"MaxRows = 1__000", "MaxRows = _1000", "MaxRows = 1000_"} {
+		if err := LoadConfigString(s, &Config{}); err == nil {
+			t.Fatalf("Misplaced underscore should not be allowed: %s", s)
+		}
+	}
+}
+
+func TestDefaultsWithCommentsOnly(t *testing.T) {
+	type Config struct {
+		Port int      `itkconfig:"default=8000"`
+		Tags []string `itkconfig:"default=a,b"`
+		Name string
+	}
+
+	config := Config{}
+	err := LoadConfig("test_configs/commentsonly.cfg", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config with only comments: %s", err.Error())
+	}
+
+	want := Config{Port: 8000, Tags: []string{"a", "b"}}
+	if !reflect.DeepEqual(want, config) {
+		t.Fatalf(`
+Defaults should be used for a config with only comments.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+}
+
+func TestNonNegative(t *testing.T) {
+	type Config struct {
+		Timeout time.Duration `itkconfig:"nonneg"`
+		Ratio   float64       `itkconfig:"nonneg"`
+		Offset  int           `itkconfig:"nonneg"`
+	}
+
+	config := Config{}
+	err := LoadConfigString("Timeout = 0s\nRatio = 0.5\nOffset = 3\n", &config)
+	if err != nil {
+		t.Fatalf("Could not parse non-negative values: %s", err.Error())
+	}
+
+	tests := []struct {
+		config string
+		want   string
+	}{
+		{"Timeout = -5s", `value -5s in key "Timeout" can not be negative`},
+		{"Ratio = -0.5", `value -0.5 in key "Ratio" can not be negative`},
+		{"Offset = -1", `value -1 in key "Offset" can not be negative`},
+	}
+	for _, test := range tests {
+		err := LoadConfigString(test.config, &Config{})
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Fatalf(`
+Negative value should not be allowed.
+	expected: %s
+	got:      %v`, test.want, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	type Config struct {
+		Name     string
+		Port     int
+		Greeting string
+	}
+
+	config := Config{Port: 1}
+	err := Validate("test_configs/map.cfg", &config)
+	if err != nil {
+		t.Fatalf("Validate should accept a valid config: %s", err.Error())
+	}
+	if config != (Config{Port: 1}) {
+		t.Fatalf("Validate should not change the config, got: %#v", config)
+	}
+
+	type InvalidConfig struct {
+		Name     string
+		Port     int
+		Greeting int
+	}
+	err = Validate("test_configs/map.cfg", (*InvalidConfig)(nil))
+	var typeErr *TypeError
+	if !errors.As(err, &typeErr) {
+		t.Fatalf("Validate should report invalid values, got: %v", err)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	type Config struct {
+		Name     string
+		Port     int
+		Greeting string
+	}
+
+	config, err := Load[Config]("test_configs/map.cfg")
+	if err != nil {
+		t.Fatalf("Could not load config: %s", err.Error())
+	}
+
+	want := Config{Name: "My app", Port: 8000, Greeting: "Hello, world"}
+	if want != config {
+		t.Fatalf(`
+Could not load config.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+}
+
+func TestWhitespaceSeparator(t *testing.T) {
+	type Config struct {
+		Name string
+		Port int
+		Host string
+	}
+
+	config := Config{}
+	err := LoadConfigWithOptions("test_configs/tabseparated.cfg", &config, Options{WhitespaceSeparator: true})
+	if err != nil {
+		t.Fatalf("Could not parse tab separated config: %s", err.Error())
+	}
+
+	want := Config{Name: "web", Port: 8000, Host: "localhost"}
+	if want != config {
+		t.Fatalf(`
+Could not parse tab separated config.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+
+	err = LoadConfig("test_configs/tabseparated.cfg", &Config{})
+	if err == nil {
+		t.Fatal("Tab separated lines should need the WhitespaceSeparator option.")
+	}
+	err = LoadConfigWithOptions("test_configs/noequals.cfg", &Config{}, Options{WhitespaceSeparator: true})
+	if err == nil || !strings.Contains(err.Error(), "line must contain '='") {
+		t.Fatalf("Line without '=' or white space should not be allowed, got: %v", err)
+	}
+}
+
+func TestPercent(t *testing.T) {
+	type Config struct {
+		CPULimit    float64 `itkconfig:"percent,max=1"`
+		MemoryLimit float32 `itkconfig:"percent"`
+		Ratio       float64 `itkconfig:"percent"`
+	}
+
+	config := Config{}
+	err := LoadConfig("test_configs/percent.cfg", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config with percentages: %s", err.Error())
+	}
+
+	want := Config{CPULimit: 0.75, MemoryLimit: 0.125, Ratio: 0.5}
+	if want != config {
+		t.Fatalf(`
+Could not parse config with percentages.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+
+	err = LoadConfigString("CPULimit = 150%", &Config{})
+	if err == nil {
+		t.Fatal("Percentage above the maximum should not be allowed.")
+	}
+
+	type PlainConfig struct {
+		Ratio float64
+	}
+	err = LoadConfigString("Ratio = 75%", &PlainConfig{})
+	if err == nil {
+		t.Fatal("Percentage should need the percent option.")
+	}
+}
+
+func TestLoadConfigReport(t *testing.T) {
+	type Config struct {
+		Port  int      `itkconfig:"default=8000"`
+		Name  string   `itkconfig:"default=web"`
+		Tags  []string `itkconfig:"tag"`
+		Debug bool
+	}
+
+	config := Config{}
+	report, err := LoadConfigReport("test_configs/report.cfg", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config with report: %s", err.Error())
+	}
+
+	want := []string{"tag", "Port"}
+	if !reflect.DeepEqual(want, report.SetKeys) {
+		t.Fatalf(`
+Report has the wrong keys.
+	expected: %#v
+	got:      %#v`, want, report.SetKeys)
+	}
+}
+
+func TestBoolNegation(t *testing.T) {
+	type Config struct {
+		Debug   bool  `itkconfig:"default=true"`
+		Color   *bool `itkconfig:"Color"`
+		Verbose bool  `itkconfig:"default=true"`
+	}
+
+	config := Config{}
+	err := LoadConfig("test_configs/negation.cfg", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config with negated bools: %s", err.Error())
+	}
+	if config.Debug || config.Color == nil || *config.Color || !config.Verbose {
+		t.Fatalf("Negated bools were not turned off: %#v", config)
+	}
+
+	err = LoadConfigString("no-Debug = true", &Config{})
+	if err == nil {
+		t.Fatal("Negated bool with a value should not be allowed.")
+	}
+	err = LoadConfigString("Debug = true\nno-Debug =\n", &Config{})
+	if err == nil {
+		t.Fatal("Bool and its negation should not both be allowed.")
+	}
+
+	type StringConfig struct {
+		Name string
+	}
+	err = LoadConfigString("no-Name =", &StringConfig{})
+	if !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("Only bools should be negated, got: %v", err)
+	}
+}
+
+func TestLoadConfigFiles(t *testing.T) {
+	type Config struct {
+		Host  string `itkconfig:"required"`
+		Port  int
+		Debug bool `itkconfig:"default=true"`
+	}
+
+	config := Config{}
+	err := LoadConfigFiles(&config, "test_configs/base.cfg", "test_configs/override.cfg")
+	if err != nil {
+		t.Fatalf("Could not load config files: %s", err.Error())
+	}
+
+	want := Config{Host: "localhost", Port: 8000, Debug: false}
+	if config != want {
+		t.Fatalf(`
+Later config file did not override the earlier one.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+
+	err = LoadConfigFiles(&config, "test_configs/base.cfg", "test_configs/nonexistent.cfg")
+	if err == nil {
+		t.Fatalf("Missing config file did not give an error")
+	}
+	opts := Options{IgnoreMissingFiles: true}
+	err = LoadConfigFilesWithOptions(&config, opts, "test_configs/base.cfg", "test_configs/nonexistent.cfg")
+	if err != nil {
+		t.Fatalf("Missing optional config file gave an error: %s", err.Error())
+	}
+}
+
+func TestKeyStyle(t *testing.T) {
+	type Config struct {
+		AdminEmail string
+		HTTPPort   int
+		MaxConns2  int
+		Title      string `itkconfig:"Name"`
+	}
+
+	config := Config{}
+	err := LoadConfigWithOptions("test_configs/snakecase.cfg", &config, Options{KeyStyle: SnakeCase})
+	if err != nil {
+		t.Fatalf("Could not parse snake_case config: %s", err.Error())
+	}
+	want := Config{AdminEmail: "foo@example.com", HTTPPort: 8080, MaxConns2: 10, Title: "web"}
+	if config != want {
+		t.Fatalf(`
+Snake case keys did not resolve to the right fields.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+
+	config = Config{}
+	d := NewDecoder(strings.NewReader("admin-email = foo@example.com\nhttp-port = 8080\n"))
+	d.KeyStyle = KebabCase
+	if err := d.Decode(&config); err != nil {
+		t.Fatalf("Could not parse kebab-case config: %s", err.Error())
+	}
+	want = Config{AdminEmail: "foo@example.com", HTTPPort: 8080}
+	if config != want {
+		t.Fatalf(`
+Kebab case keys did not resolve to the right fields.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+
+	config = Config{}
+	err = LoadConfigWithOptions("test_configs/snakecase.cfg", &config, Options{})
+	if !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("Snake case key matched a field without KeyStyle: %v", err)
+	}
+}
+
+func TestTextAfterClosingQuote(t *testing.T) {
+	type Config struct {
+		Foo string
+	}
+
+	config := Config{}
+	err := LoadConfigString(`Foo = "bar" baz`, &config)
+	if !errors.Is(err, ErrSyntax) {
+		t.Fatalf("Text after closing quote did not give a syntax error: %v", err)
+	}
+
+	err = LoadConfigString(`Key = "a" "b"`, &config)
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) || parseErr.Column != 11 {
+		t.Fatalf("Second quoted string did not give an error at its column: %v", err)
+	}
+
+	err = LoadConfigString(`Foo = "bar" # comment`, &config)
+	if err != nil {
+		t.Fatalf("Could not parse quoted value with comment: %s", err.Error())
+	}
+	if config.Foo != "bar" {
+		t.Fatalf(`
+Quoted value with comment parsed wrong.
+	expected: %#v
+	got:      %#v`, "bar", config.Foo)
+	}
+}
+
+type testColor struct {
+	R, G, B, A uint8
+}
+
+func TestRegisterParser(t *testing.T) {
+	RegisterParser(reflect.TypeOf(testColor{}), func(value string) (interface{}, error) {
+		c := testColor{A: 0xff}
+		_, err := fmt.Sscanf(value, "#%02x%02x%02x", &c.R, &c.G, &c.B)
+		return c, err
+	})
+
+	type Config struct {
+		Background testColor
+		Foreground testColor
+	}
+
+	config := Config{}
+	err := LoadConfig("test_configs/colors.cfg", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config with registered parser: %s", err.Error())
+	}
+	want := Config{
+		Background: testColor{R: 0xff, G: 0x88, B: 0x00, A: 0xff},
+		Foreground: testColor{A: 0xff},
+	}
+	if config != want {
+		t.Fatalf(`
+Registered parser gave the wrong values.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+
+	err = LoadConfigString(`Background = "orange"`, &config)
+	var typeErr *TypeError
+	if !errors.As(err, &typeErr) {
+		t.Fatalf("Invalid value for registered parser did not give a TypeError: %v", err)
+	}
+}
+
+type testLevel int
+
+type testVersion struct {
+	Major, Minor int
+}
+
+func TestRegisterType(t *testing.T) {
+	levels := map[string]testLevel{"debug": 0, "info": 1, "error": 2}
+	parseLevel := func(value string) (interface{}, error) {
+		level, ok := levels[value]
+		if !ok {
+			return nil, fmt.Errorf("unknown level")
+		}
+		return level, nil
+	}
+	parseVersion := func(value string) (interface{}, error) {
+		v := testVersion{}
+		_, err := fmt.Sscanf(value, "v%d.%d", &v.Major, &v.Minor)
+		return v, err
+	}
+
+	// Registering types concurrently is safe.
+	done := make(chan bool)
+	go func() {
+		RegisterType(reflect.TypeOf(testLevel(0)), parseLevel)
+		done <- true
+	}()
+	RegisterType(reflect.TypeOf(testVersion{}), parseVersion)
+	<-done
+
+	type Config struct {
+		Level   testLevel
+		Ignore  []testLevel
+		Version testVersion
+	}
+
+	config := Config{}
+	err := LoadConfigString("Level = error\nIgnore = debug\nIgnore = info\nVersion = v1.4\n", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config with registered types: %s", err.Error())
+	}
+	want := Config{Level: 2, Ignore: []testLevel{0, 1}, Version: testVersion{1, 4}}
+	if !reflect.DeepEqual(want, config) {
+		t.Fatalf(`
+Registered types were parsed wrong.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+}
+
+func TestSecretRedacted(t *testing.T) {
+	type Config struct {
+		User string
+		PIN  int `itkconfig:"secret"`
+	}
+
+	config := Config{}
+	err := LoadConfigString("User = admin\nPIN = hunter2\n", &config)
+	if err == nil {
+		t.Fatalf("Invalid secret value did not give an error")
+	}
+	if strings.Contains(err.Error(), "hunter2") {
+		t.Fatalf("Error leaks the value of a secret field: %s", err.Error())
+	}
+	want := `syntax error parsing config (<string>:2:7) in "PIN = ***": invalid int "***" in key "PIN"`
+	if err.Error() != want {
+		t.Fatalf(`
+Wrong error for secret field.
+	expected: %#v
+	got:      %#v`, want, err.Error())
+	}
+}
+
+func TestOneOf(t *testing.T) {
+	type Config struct {
+		LogLevel string `itkconfig:"oneof=debug info warn error"`
+	}
+
+	config := Config{}
+	err := LoadConfigString("LogLevel = warn", &config)
+	if err != nil {
+		t.Fatalf("Could not parse allowed value: %s", err.Error())
+	}
+	if config.LogLevel != "warn" {
+		t.Fatalf(`
+Allowed value parsed wrong.
+	expected: %#v
+	got:      %#v`, "warn", config.LogLevel)
+	}
+
+	err = LoadConfigString("LogLevel = trace", &config)
+	if err == nil {
+		t.Fatalf("Value not allowed by oneof did not give an error")
+	}
+	want := `value "trace" in key "LogLevel" must be one of: debug, info, warn, error`
+	if !strings.HasSuffix(err.Error(), want) {
+		t.Fatalf(`
+Wrong error for value not allowed by oneof.
+	expected: %#v
+	got:      %#v`, want, err.Error())
+	}
+}
+
+func TestLoadConfigGzip(t *testing.T) {
+	type Config struct {
+		Name string
+		Port int
+	}
+
+	filename := t.TempDir() + "/app.cfg.gz"
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatalf("Could not create config file: %s", err.Error())
+	}
+	zw := gzip.NewWriter(f)
+	zw.Write([]byte("# Compressed config\nName = web\nPort = 8000\n"))
+	zw.Close()
+	f.Close()
+
+	config := Config{}
+	if err := LoadConfig(filename, &config); err != nil {
+		t.Fatalf("Could not parse gzip compressed config: %s", err.Error())
+	}
+	want := Config{Name: "web", Port: 8000}
+	if config != want {
+		t.Fatalf(`
+Gzip compressed config parsed wrong.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+}
+
+func TestLoadConfigNotExist(t *testing.T) {
+	type Config struct {
+		Foo string
+	}
+
+	err := LoadConfig("test_configs/nonexistent.cfg", &Config{})
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Missing config file did not give an error matching fs.ErrNotExist: %v", err)
+	}
+	want := "cannot load config: open test_configs/nonexistent.cfg: "
+	if !strings.HasPrefix(err.Error(), want) {
+		t.Fatalf(`
+Wrong error for missing config file.
+	expected: %#v
+	got:      %#v`, want+"...", err.Error())
+	}
+}
+
+func TestLoadConfigOptional(t *testing.T) {
+	type Config struct {
+		Foo string
+	}
+
+	config := Config{Foo: "default"}
+	err := LoadConfigOptional("test_configs/nonexistent.cfg", &config)
+	if err != nil {
+		t.Fatalf("Missing optional config file gave an error: %s", err.Error())
+	}
+	if config.Foo != "default" {
+		t.Fatalf(`
+Missing optional config file changed the config.
+	expected: %#v
+	got:      %#v`, "default", config.Foo)
+	}
+
+	err = LoadConfigOptional("test_configs/noequals.cfg", &config)
+	if err == nil {
+		t.Fatalf("Invalid optional config file did not give an error")
+	}
+}
+
+func TestDurationUnit(t *testing.T) {
+	type Config struct {
+		Timeout  time.Duration `itkconfig:"unit=s"`
+		Interval time.Duration `itkconfig:"unit=ms"`
+	}
+
+	config := Config{}
+	err := LoadConfigString("Timeout = 30\nInterval = 1m\n", &config)
+	if err != nil {
+		t.Fatalf("Could not parse durations with unit: %s", err.Error())
+	}
+	want := Config{Timeout: 30 * time.Second, Interval: time.Minute}
+	if config != want {
+		t.Fatalf(`
+Durations with unit parsed wrong.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+}
+
+func TestSections(t *testing.T) {
+	type Database struct {
+		Host string
+		Port int
+		User string `itkconfig:"default=app"`
+	}
+	type Cache struct {
+		Size int
+	}
+	type Config struct {
+		Name     string
+		Database Database `itkconfig:"database"`
+		Cache    *Cache   `itkconfig:"cache"`
+	}
+
+	config := Config{}
+	err := LoadConfig("test_configs/sections.cfg", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config with sections: %s", err.Error())
+	}
+	want := Config{
+		Name:     "web",
+		Database: Database{Host: "db.example.com", Port: 5432, User: "app"},
+		Cache:    &Cache{Size: 100},
+	}
+	if !reflect.DeepEqual(want, config) {
+		t.Fatalf(`
+Sections parsed wrong.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+
+	config = Config{}
+	err = LoadConfigString("Name = web\n[database] # user=app\nHost = localhost\n", &config)
+	if err != nil {
+		t.Fatalf("Could not parse section header with '=' in its comment: %s", err.Error())
+	}
+	if config.Database.Host != "localhost" {
+		t.Fatalf(`
+Section with '=' in the comment of its header parsed wrong.
+	expected: %#v
+	got:      %#v`, "localhost", config.Database.Host)
+	}
+
+	err = LoadConfigString("Name = web\n[database\nHost = localhost\n", &config)
+	want2 := `syntax error parsing config (<string>:2:10) in "[database": section header is missing closing ]`
+	if err == nil || err.Error() != want2 {
+		t.Fatalf(`
+Wrong error for malformed section header.
+	expected: %#v
+	got:      %v`, want2, err)
+	}
+
+	err = LoadConfigString("[logging]\nLevel = info\n", &config)
+	if !errors.Is(err, ErrSyntax) {
+		t.Fatalf("Unknown section did not give a syntax error: %v", err)
+	}
+
+	// With unknown keys allowed, an unknown section is skipped up to the
+	// next header, keys and all.
+	config = Config{}
+	d := NewDecoder(strings.NewReader("[logging]\nLevel = info\nHost = log.example.com\n[database]\nHost = localhost\n"))
+	d.AllowUnknownKeys = true
+	if err := d.Decode(&config); err != nil {
+		t.Fatalf("Could not skip unknown section: %s", err.Error())
+	}
+	if config.Database.Host != "localhost" {
+		t.Fatalf(`
+Keys after unknown section parsed wrong.
+	expected: %#v
+	got:      %#v`, "localhost", config.Database.Host)
+	}
+}
+
+func TestRepeatedSections(t *testing.T) {
+	type Server struct {
+		Host string
+		Port int `itkconfig:"default=80"`
+	}
+	type Config struct {
+		Servers []Server `itkconfig:"server"`
+	}
+
+	config := Config{Servers: []Server{{Host: "default.example.com"}}}
+	err := LoadConfig("test_configs/repeatedsections.cfg", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config with repeated sections: %s", err.Error())
+	}
+	want := Config{Servers: []Server{
+		{Host: "a.example.com", Port: 8080},
+		{Host: "b.example.com", Port: 80},
+	}}
+	if !reflect.DeepEqual(want, config) {
+		t.Fatalf(`
+Repeated sections parsed wrong.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+}
+
+func TestMustLoadConfig(t *testing.T) {
+	type Config struct {
+		Foo string
+	}
+
+	mustLoad := func(filename string) (panicked bool) {
+		defer func() {
+			panicked = recover() != nil
+		}()
+		MustLoadConfig(filename, &Config{})
+		return false
+	}
+
+	if mustLoad("test_configs/string.cfg") {
+		t.Fatalf("MustLoadConfig panicked on a valid config")
+	}
+	if !mustLoad("test_configs/noequals.cfg") {
+		t.Fatalf("MustLoadConfig did not panic on an invalid config")
+	}
+}
+
+func TestEnvPrefix(t *testing.T) {
+	type Config struct {
+		Host       string
+		Port       int    `itkconfig:"required"`
+		AdminEmail string `itkconfig:"admin-email"`
+	}
+
+	t.Setenv("MYAPP_HOST", "env.example.com")
+	t.Setenv("MYAPP_PORT", "9000")
+	t.Setenv("MYAPP_ADMIN_EMAIL", "foo@example.com")
+
+	config := Config{}
+	d := NewDecoder(strings.NewReader("Host = localhost\n"))
+	d.EnvPrefix = "MYAPP_"
+	if err := d.Decode(&config); err != nil {
+		t.Fatalf("Could not parse config with environment fallback: %s", err.Error())
+	}
+	want := Config{Host: "localhost", Port: 9000, AdminEmail: "foo@example.com"}
+	if config != want {
+		t.Fatalf(`
+Environment did not fill the unset fields.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+}
+
+func TestFinite(t *testing.T) {
+	type Config struct {
+		Ratio float64 `itkconfig:"finite"`
+	}
+
+	config := Config{}
+	err := LoadConfigString("Ratio = 0.5", &config)
+	if err != nil {
+		t.Fatalf("Could not parse finite float: %s", err.Error())
+	}
+	if config.Ratio != 0.5 {
+		t.Fatalf(`
+Finite float parsed wrong.
+	expected: %#v
+	got:      %#v`, 0.5, config.Ratio)
+	}
+
+	for _, value := range []string{"Inf", "-inf", "NaN"} {
+		err := LoadConfigString("Ratio = "+value, &config)
+		if err == nil {
+			t.Fatalf("Non-finite value %s did not give an error", value)
+		}
+	}
+}
+
+func TestLoadConfigStdin(t *testing.T) {
+	type Config struct {
+		Foo string
+	}
+
+	defer func(r io.Reader) { stdin = r }(stdin)
+	stdin = strings.NewReader("Foo = from stdin\n")
+
+	config := Config{}
+	if err := LoadConfig("-", &config); err != nil {
+		t.Fatalf("Could not parse config from stdin: %s", err.Error())
+	}
+	if config.Foo != "from stdin" {
+		t.Fatalf(`
+Config from stdin parsed wrong.
+	expected: %#v
+	got:      %#v`, "from stdin", config.Foo)
+	}
+}
+
+func TestRegisterFieldTransform(t *testing.T) {
+	type Config struct {
+		Code  string
+		Codes []string
+		Name  string
+	}
+	RegisterFieldTransform(reflect.TypeOf(Config{}), "Code", func(value string) (string, error) {
+		return strings.ToUpper(value), nil
+	})
+	RegisterFieldTransform(reflect.TypeOf(Config{}), "Codes", func(value string) (string, error) {
+		return strings.ToUpper(value), nil
+	})
+
+	config := Config{}
+	err := LoadConfigString("Code = abc\nCodes = [x, y]\nName = abc\n", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config with transform: %s", err.Error())
+	}
+	want := Config{Code: "ABC", Codes: []string{"X", "Y"}, Name: "abc"}
+	if !reflect.DeepEqual(want, config) {
+		t.Fatalf(`
+Field transform was applied wrong.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+}
+
+func TestValueFromFile(t *testing.T) {
+	type Config struct {
+		TLSKey string
+		Handle string
+	}
+
+	filename := t.TempDir() + "/tls.pem"
+	if err := os.WriteFile(filename, []byte("secret key\n"), 0600); err != nil {
+		t.Fatalf("Could not write value file: %s", err.Error())
+	}
+
+	config := Config{}
+	err := LoadConfigString("TLSKey = @"+filename+"\nHandle = \\@itk\n", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config with value from file: %s", err.Error())
+	}
+	want := Config{TLSKey: "secret key", Handle: "@itk"}
+	if config != want {
+		t.Fatalf(`
+Value from file parsed wrong.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+
+	err = LoadConfigString("TLSKey = @test_configs/nonexistent.pem", &config)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Missing value file did not give an error: %v", err)
+	}
+}
+
+func TestGroupedInt(t *testing.T) {
+	type Config struct {
+		MaxRows  int  `itkconfig:"grouped"`
+		MaxBytes uint `itkconfig:"grouped"`
+		Strict   int
+	}
+
+	config := Config{}
+	err := LoadConfigString("MaxRows = 1,000,000\nMaxBytes = 2048\n", &config)
+	if err != nil {
+		t.Fatalf("Could not parse grouped integers: %s", err.Error())
+	}
+	want := Config{MaxRows: 1000000, MaxBytes: 2048}
+	if config != want {
+		t.Fatalf(`
+Grouped integers parsed wrong.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+
+	err = LoadConfigString("Strict = 1,000", &config)
+	if err == nil {
+		t.Fatalf("Grouped integer without the grouped option did not give an error")
+	}
+}
+
+func TestSliceReset(t *testing.T) {
+	type Config struct {
+		Tags  []string
+		Ports []int
+	}
+
+	opts := Options{SliceMergeMode: SliceAppend}
+	config := Config{}
+	err := LoadConfigFilesWithOptions(&config, opts, "test_configs/slicereset_base.cfg", "test_configs/slicereset.cfg")
+	if err != nil {
+		t.Fatalf("Could not parse configs with slice reset: %s", err.Error())
+	}
+	want := Config{Tags: []string{"extra"}}
+	if !reflect.DeepEqual(want, config) {
+		t.Fatalf(`
+Empty list did not clear the slice.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+
+	config = Config{}
+	err = LoadConfigString("Ports = 80\nPorts = []\n", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config with slice reset: %s", err.Error())
+	}
+	if len(config.Ports) != 0 {
+		t.Fatalf(`
+Empty list did not clear the slice.
+	expected: %#v
+	got:      %#v`, []int{}, config.Ports)
+	}
+}
+
+func TestDeprecatedKey(t *testing.T) {
+	type Config struct {
+		OldPort int `itkconfig:"deprecated=use Port instead"`
+		Port    int
+	}
+
+	var buf bytes.Buffer
+	d := NewDecoder(strings.NewReader("Port = 80\nOldPort = 8000\n"))
+	d.Logger = log.New(&buf, "", 0)
+	config := Config{}
+	if err := d.Decode(&config); err != nil {
+		t.Fatalf("Could not parse config with deprecated key: %s", err.Error())
+	}
+	if config.OldPort != 8000 {
+		t.Fatalf(`
+Deprecated key was not set.
+	expected: %#v
+	got:      %#v`, 8000, config.OldPort)
+	}
+
+	want := "config key 'OldPort' (<reader>:2) is deprecated: use Port instead\n"
+	if buf.String() != want {
+		t.Fatalf(`
+Wrong deprecation warning.
+	expected: %#v
+	got:      %#v`, want, buf.String())
+	}
+}
+
+func TestAlias(t *testing.T) {
+	type Config struct {
+		AdminEmail []string `itkconfig:"AdminEmail,alias=Admins,Admin"`
+		Port       int
+	}
+
+	config := Config{}
+	err := LoadConfigString("Admins = foo@example.com\nAdmin = bar@example.com\nPort = 80\n", &config)
+	if err != nil {
+		t.Fatalf("Could not parse config with aliases: %s", err.Error())
+	}
+	want := Config{AdminEmail: []string{"foo@example.com", "bar@example.com"}, Port: 80}
+	if !reflect.DeepEqual(want, config) {
+		t.Fatalf(`
+Aliases did not set the field.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+
+	type Conflict struct {
+		AdminEmail string `itkconfig:"alias=Admin"`
+		Admins     string `itkconfig:"alias=Admin"`
+	}
+	err = LoadConfigString("", &Conflict{})
+	want2 := "config key 'Admin' of field Admins collides with key 'Admin' of field AdminEmail"
+	if err == nil || err.Error() != want2 {
+		t.Fatalf(`
+Wrong error for conflicting aliases.
+	expected: %#v
+	got:      %v`, want2, err)
+	}
+}
+
+func TestContinuedValueErrorLine(t *testing.T) {
+	type Config struct {
+		Name string
+		Port int
+	}
+
+	config := Config{}
+	err := LoadConfigString("Name = foo\nPort = 80 \\\n  x\n", &config)
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) {
+		t.Fatalf("Invalid continued value did not give a ParseError: %v", err)
+	}
+	if parseErr.Line != 2 {
+		t.Fatalf(`
+Wrong line for error in continued value.
+	expected: %#v
+	got:      %#v`, uint(2), parseErr.Line)
+	}
+	if parseErr.Text != "Port = 80 \\" {
+		t.Fatalf(`
+Wrong text for error in continued value.
+	expected: %#v
+	got:      %#v`, "Port = 80 \\", parseErr.Text)
+	}
+}
+
+func TestBareBools(t *testing.T) {
+	type Config struct {
+		Verbose bool
+		Debug   *bool
+		Color   bool `itkconfig:"default=true"`
+		Name    string
+	}
+
+	config := Config{}
+	d := NewDecoder(strings.NewReader("Verbose\nDebug # on\nno-Color\n"))
+	d.BareBools = true
+	if err := d.Decode(&config); err != nil {
+		t.Fatalf("Could not parse bare bool keys: %s", err.Error())
+	}
+	if !config.Verbose || config.Debug == nil || !*config.Debug || config.Color {
+		t.Fatalf(`
+Bare bool keys parsed wrong.
+	expected: %#v
+	got:      %#v`, "Verbose, Debug and not Color", config)
+	}
+
+	d = NewDecoder(strings.NewReader("Name\n"))
+	d.BareBools = true
+	if err := d.Decode(&Config{}); !errors.Is(err, ErrSyntax) {
+		t.Fatalf("Bare key for a string field did not give a syntax error: %v", err)
+	}
+
+	if err := LoadConfigString("Verbose\n", &Config{}); !errors.Is(err, ErrSyntax) {
+		t.Fatalf("Bare key without the BareBools option did not give a syntax error: %v", err)
+	}
+}
+
+func TestRequiredIf(t *testing.T) {
+	type Config struct {
+		TLSEnabled bool
+		TLSKey     string `itkconfig:"requiredif=TLSEnabled"`
+	}
+
+	err := LoadConfigString("TLSEnabled = true\n", &Config{})
+	want := "missing required keys in config (<string>): 'TLSKey' (required as 'TLSEnabled' is set)"
+	if err == nil || err.Error() != want {
+		t.Fatalf(`
+Wrong error for missing key required by a set field.
+	expected: %#v
+	got:      %v`, want, err)
+	}
+
+	config := Config{}
+	if err := LoadConfigString("TLSEnabled = true\nTLSKey = key.pem\n", &config); err != nil {
+		t.Fatalf("Could not parse config with dependent key set: %s", err.Error())
+	}
+	if err := LoadConfigString("TLSEnabled = false\n", &Config{}); err != nil {
+		t.Fatalf("Dependent key was required without its dependency set: %s", err.Error())
+	}
+
+	type BadConfig struct {
+		TLSKey string `itkconfig:"requiredif=Missing"`
+	}
+	if err := LoadConfigString("", &BadConfig{}); err == nil {
+		t.Fatal("Required if an unknown field did not give an error.")
+	}
+}
+
+func TestKeyWithWhiteSpace(t *testing.T) {
+	type Config struct {
+		Port int
+	}
+
+	err := LoadConfigString("Po rt = 8000\n", &Config{})
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) || errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("Key with white space did not give a syntax error: %v", err)
+	}
+	want := "key \"Po rt\" cannot contain white space"
+	if parseErr.Msg != want {
+		t.Fatalf(`
+Wrong error for key with white space.
+	expected: %#v
+	got:      %#v`, want, parseErr.Msg)
+	}
+
+	config := Config{}
+	if err := LoadConfigString("Port  = 8000\n", &config); err != nil {
+		t.Fatalf("Could not parse key followed by white space: %s", err.Error())
+	}
+}
+
+func TestJSONField(t *testing.T) {
+	type Server struct {
+		Host string
+		Port int
+	}
+	type Config struct {
+		Name   string
+		Server Server         `itkconfig:"json"`
+		Labels map[string]int `itkconfig:"json"`
+	}
+
+	config := Config{}
+	err := LoadConfigString(`Name = web
+Server = {"Host": "example.com", "Port": 8080} # the backend
+Labels = """
+{"a": 1, "b": 2}
+"""
+`, &config)
+	if err != nil {
+		t.Fatalf("Could not parse JSON fields: %s", err.Error())
+	}
+	want := Config{
+		Name:   "web",
+		Server: Server{Host: "example.com", Port: 8080},
+		Labels: map[string]int{"a": 1, "b": 2},
+	}
+	if !reflect.DeepEqual(want, config) {
+		t.Fatalf(`
+JSON fields parsed wrong.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+
+	err = LoadConfigString(`Server = {"Port": "x"}`, &Config{})
+	var typeErr *TypeError
+	if !errors.As(err, &typeErr) || typeErr.Type != "JSON" {
+		t.Fatalf("Invalid JSON value did not give a TypeError: %v", err)
+	}
+
+	err = LoadConfigString(`Server = {"Port": 1} extra`, &Config{})
+	if !errors.Is(err, ErrSyntax) {
+		t.Fatalf("Text after JSON value did not give a syntax error: %v", err)
+	}
+
+	err = LoadConfigString("[Server]\nHost = x\n", &Config{})
+	if !errors.Is(err, ErrSyntax) {
+		t.Fatalf("JSON field used as a section did not give a syntax error: %v", err)
+	}
+}
+
+func TestConditionalBlock(t *testing.T) {
+	type Config struct {
+		Port    int
+		TLSCert string
+	}
+
+	data := "Port = 8000\n@if ENV=prod # production only\nTLSCert = app.pem\n@endif\n"
+	for _, env := range []string{"prod", "dev"} {
+		config := Config{}
+		d := NewDecoder(strings.NewReader(data))
+		d.Vars = map[string]string{"ENV": env}
+		if err := d.Decode(&config); err != nil {
+			t.Fatalf("Could not parse config with conditional block: %s", err.Error())
+		}
+		want := Config{Port: 8000}
+		if env == "prod" {
+			want.TLSCert = "app.pem"
+		}
+		if config != want {
+			t.Fatalf(`
+Conditional block parsed wrong for ENV=%s.
+	expected: %#v
+	got:      %#v`, env, want, config)
+		}
+	}
+
+	for _, data := range []string{
+		"@if ENV=prod\nPort = 1\n",
+		"@endif\n",
+		"@if ENV=prod\n@if ENV=dev\n@endif\n@endif\n",
+		"@if ENV\n@endif\n",
+	} {
+		if err := LoadConfigString(data, &Config{}); !errors.Is(err, ErrSyntax) {
+			t.Fatalf("Invalid conditional block %q did not give a syntax error: %v", data, err)
+		}
+	}
+}
+
+func TestSecretRedactedRange(t *testing.T) {
+	type Config struct {
+		Pin int `itkconfig:",secret,max=10"`
+	}
+
+	for _, value := range []string{"0x1F40", "8_000"} {
+		err := LoadConfigString("Pin = "+value, &Config{})
+		var rangeErr *RangeError
+		if !errors.As(err, &rangeErr) {
+			t.Fatalf("Secret value out of range did not give a RangeError: %v", err)
+		}
+		if strings.Contains(err.Error(), "8000") || strings.Contains(err.Error(), value) {
+			t.Fatalf("Error leaks the value of a secret field: %s", err.Error())
+		}
+		want := `syntax error parsing config (<string>:1:7) in "Pin = ***": value *** in key "Pin" is above the maximum of 10`
+		if err.Error() != want {
+			t.Fatalf(`
+Wrong error for secret value out of range.
+	expected: %#v
+	got:      %#v`, want, err.Error())
+		}
+	}
+}
+
+func TestEnvPrefixSecret(t *testing.T) {
+	type Config struct {
+		Password int `itkconfig:",secret"`
+	}
+
+	t.Setenv("APP_PASSWORD", "hunter2")
+	d := NewDecoder(strings.NewReader(""))
+	d.EnvPrefix = "APP_"
+	err := d.Decode(&Config{})
+	if err == nil {
+		t.Fatal("Invalid secret environment variable did not give an error")
+	}
+	want := `invalid environment variable APP_PASSWORD: invalid int "***" in key "Password"`
+	if err.Error() != want {
+		t.Fatalf(`
+Wrong error for invalid secret environment variable.
+	expected: %#v
+	got:      %#v`, want, err.Error())
+	}
+}
+
+func TestLoadConfigFilesRequiredSection(t *testing.T) {
+	type Database struct {
+		Host string
+		Port int
+	}
+	type Cache struct {
+		Size int
+	}
+	type Config struct {
+		Name     string
+		Database *Database `itkconfig:"database,required"`
+		Cache    *Cache    `itkconfig:"cache"`
+	}
+
+	config := Config{}
+	err := LoadConfigFiles(&config, "test_configs/sections.cfg")
+	if err != nil {
+		t.Fatalf("Could not load config files with a required section: %s", err.Error())
+	}
+	if config.Database == nil || config.Database.Host != "db.example.com" {
+		t.Fatalf(`
+Required section loaded wrong.
+	expected: %#v
+	got:      %#v`, &Database{Host: "db.example.com", Port: 5432}, config.Database)
+	}
+
+	report, err := LoadConfigReport("test_configs/sections.cfg", &Config{})
+	if err != nil {
+		t.Fatalf("Could not load config with sections: %s", err.Error())
+	}
+	want := []string{"Name", "database", "database.Host", "database.Port", "cache", "cache.Size"}
+	if !reflect.DeepEqual(want, report.SetKeys) {
+		t.Fatalf(`
+Sections were not reported as set.
+	expected: %#v
+	got:      %#v`, want, report.SetKeys)
+	}
+}
+
+func TestRequiredInSection(t *testing.T) {
+	type Database struct {
+		Host string `itkconfig:",required"`
+		Port int
+	}
+	type Config struct {
+		Name     string
+		Database *Database `itkconfig:"db"`
+	}
+
+	err := LoadConfigString("[db]\nPort = 5\n", &Config{})
+	want := "missing required keys in config (<string>): 'db.Host'"
+	if err == nil || err.Error() != want {
+		t.Fatalf(`
+Wrong error for missing required key in section.
+	expected: %#v
+	got:      %v`, want, err)
+	}
+
+	if err := LoadConfigString("Name = web\n", &Config{}); err != nil {
+		t.Fatalf("Required key of absent section gave an error: %s", err.Error())
+	}
+	if err := LoadConfigString("[db]\nHost = localhost\n", &Config{}); err != nil {
+		t.Fatalf("Could not parse section with required key: %s", err.Error())
+	}
+
+	dir := t.TempDir()
+	base, override := dir+"/base.cfg", dir+"/override.cfg"
+	if err := os.WriteFile(base, []byte("[db]\nHost = localhost\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(override, []byte("[db]\nPort = 5\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadConfigFiles(&Config{}, base, override); err != nil {
+		t.Fatalf("Required key in section of earlier file gave an error: %s", err.Error())
+	}
+	if err := LoadConfigFiles(&Config{}, override); err == nil {
+		t.Fatal("Missing required key in section of config files did not give an error")
+	}
+
+	type Server struct {
+		Host string `itkconfig:",required"`
+	}
+	type Servers struct {
+		Servers []Server `itkconfig:"server"`
+	}
+	err = LoadConfigString("[server]\nHost = a\n[server]\n", &Servers{})
+	want = "missing required keys in config (<string>): 'server.Host'"
+	if err == nil || err.Error() != want {
+		t.Fatalf(`
+Wrong error for missing required key in repeated section.
+	expected: %#v
+	got:      %v`, want, err)
+	}
+}
+
+func TestValueFromFileLiteral(t *testing.T) {
+	type Config struct {
+		Handle string
+		Quoted string
+		Tags   []string
+	}
+
+	filename := t.TempDir() + "/tls.pem"
+	if err := os.WriteFile(filename, []byte("secret key\n"), 0600); err != nil {
+		t.Fatalf("Could not write value file: %s", err.Error())
+	}
+	t.Setenv("ITKCONFIG_TEST_HANDLE", "@"+filename)
+
+	config := Config{}
+	data := "Handle = ${ITKCONFIG_TEST_HANDLE}\nQuoted = \"@" + filename + "\"\nTags = [\"@y\", \\@z, \\\\@w]\n"
+	if err := LoadConfigString(data, &config); err != nil {
+		t.Fatalf("Could not parse config with literal @ values: %s", err.Error())
+	}
+	want := Config{Handle: "@" + filename, Quoted: "@" + filename, Tags: []string{"@y", "@z", "\\@w"}}
+	if !reflect.DeepEqual(want, config) {
+		t.Fatalf(`
+Values that do not refer to a file parsed wrong.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+}
+
+func TestWalkConditionalBlock(t *testing.T) {
+	var keys []string
+	data := "Port = 8000\n@if ENV=prod\nTLSCert = app.pem\n@endif\n"
+	err := Walk(strings.NewReader(data), func(key, value string, line uint) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Could not walk config with conditional block: %s", err.Error())
+	}
+	want := []string{"Port", "TLSCert"}
+	if !reflect.DeepEqual(want, keys) {
+		t.Fatalf(`
+Keys in conditional block were not walked.
+	expected: %#v
+	got:      %#v`, want, keys)
+	}
+}
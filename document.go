@@ -0,0 +1,284 @@
+// Copyright (c) 2014 Trygve Aaberge and contributors
+// Released under the LGPLv2.1, see LICENSE
+
+package itkconfig
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// docEntry is a key-value pair of a Document, or a blank or comment line.
+type docEntry struct {
+	// key is the key of the pair, prefixed by its section and a dot if it is
+	// in a section. It is empty for blank, comment and section header lines.
+	key string
+	// lines holds the lines of the entry as written.
+	lines []string
+	// valueColumn is the 1-based byte offset of the value into the first
+	// line.
+	valueColumn int
+	// comment is the comment following the value, including the white space
+	// before it, for pairs written on a single line.
+	comment string
+	// section is the name of the section the entry is in, or of the section
+	// it starts if header is set.
+	section string
+	header  bool
+	// conditional reports whether the entry is a pair in an @if block.
+	conditional bool
+}
+
+// A Document is a config file that can be edited while keeping its comments,
+// blank lines and the order of its keys. Only the key-value pairs that are
+// changed are rewritten. The pairs in @if blocks are part of the document
+// whatever their condition.
+type Document struct {
+	entries []docEntry
+	// bom reports whether the file started with a byte order mark.
+	bom bool
+	// newline ends every line, \r\n if the first line of the file ended
+	// with it and \n otherwise. It is empty for a Document that was not
+	// parsed, like the zero value, which uses \n.
+	newline string
+}
+
+// LoadDocument reads the config file filename into a Document.
+func LoadDocument(filename string) (*Document, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return parseDocument(data, filename)
+}
+
+// ParseDocument parses the config file in data into a Document.
+func ParseDocument(data []byte) (*Document, error) {
+	return parseDocument(data, "<document>")
+}
+
+func parseDocument(data []byte, source string) (*Document, error) {
+	doc := &Document{newline: "\n"}
+	text := strings.TrimSuffix(string(data), "\n")
+	if strings.HasPrefix(text, byteOrderMark) {
+		text = text[len(byteOrderMark):]
+		doc.bom = true
+	}
+	var lines []string
+	if text != "" {
+		lines = strings.Split(text, "\n")
+	}
+	if len(lines) > 0 && strings.HasSuffix(lines[0], "\r") {
+		doc.newline = "\r\n"
+	}
+	for i, line := range lines {
+		lines[i] = strings.TrimSuffix(line, "\r")
+	}
+
+	// next is the number of the first line not yet added to an entry, and
+	// section is the section it is in.
+	next := uint(1)
+	section := ""
+	addLinesBefore := func(lineNr uint) {
+		for ; next < lineNr; next++ {
+			doc.entries = append(doc.entries, docEntry{lines: []string{lines[next-1]}, section: section})
+		}
+	}
+
+	s := newScanner(context.Background(), strings.NewReader(text), source, "#")
+	s.allBlocks = true
+	for {
+		p, err := s.next()
+		if err != nil {
+			return nil, err
+		}
+		if p == nil {
+			break
+		}
+		addLinesBefore(p.line)
+		if p.header {
+			section = p.key
+			doc.entries = append(doc.entries, docEntry{lines: []string{lines[p.line-1]}, section: section, header: true})
+			next = p.line + 1
+			continue
+		}
+
+		entry := docEntry{
+			key:         p.qualifiedKey(),
+			lines:       lines[p.line-1 : s.lineNr],
+			valueColumn: p.valueColumn,
+			section:     section,
+			conditional: p.conditional,
+		}
+		if len(entry.lines) == 1 && !p.multiline {
+			_, entry.comment = splitComment(p.rawValue, "#")
+		}
+		doc.entries = append(doc.entries, entry)
+		next = s.lineNr + 1
+	}
+	addLinesBefore(uint(len(lines)) + 1)
+
+	return doc, nil
+}
+
+// Set sets the value of key. If key is already defined, its definition is
+// replaced, keeping any comment at the end of its line. Otherwise it is added
+// after the last key of its section, or before the first section header for
+// keys that are not in a section. The key of a section, like Port in the
+// section db, is given as db.Port, and a section the document does not have
+// is added at its end. The value is quoted and escaped as needed. Set returns
+// an error if key is defined more than once, as for a slice, or if the value
+// can not be written on a single line.
+func (d *Document) Set(key, value string) error {
+	quoted, err := quoteVal(key, value)
+	if err != nil {
+		return err
+	}
+
+	index := -1
+	for i, entry := range d.entries {
+		if entry.key != key {
+			continue
+		}
+		if index != -1 {
+			return fmt.Errorf("cannot set key \"%s\": it is defined multiple times", key)
+		}
+		index = i
+	}
+
+	if index == -1 {
+		section, name, ok := d.splitKey(key)
+		line := strings.ReplaceAll(name, "=", "\\=") + " = "
+		entry := docEntry{
+			key:         key,
+			lines:       []string{line + quoted},
+			valueColumn: len(line) + 1,
+			section:     section,
+		}
+		if !ok {
+			// The section is added at the end of the document, after a
+			// blank line.
+			if n := len(d.entries); n > 0 && d.entries[n-1].lines[0] != "" {
+				d.entries = append(d.entries, docEntry{lines: []string{""}, section: d.entries[len(d.entries)-1].section})
+			}
+			d.entries = append(d.entries, docEntry{lines: []string{"[" + section + "]"}, section: section, header: true}, entry)
+			return nil
+		}
+		at := d.insertIndex(section)
+		d.entries = append(d.entries[:at], append([]docEntry{entry}, d.entries[at:]...)...)
+		return nil
+	}
+
+	entry := &d.entries[index]
+	prefix := entry.lines[0]
+	if entry.valueColumn-1 < len(prefix) {
+		prefix = prefix[:entry.valueColumn-1]
+	}
+	if !strings.HasSuffix(prefix, " ") && !strings.HasSuffix(prefix, "\t") {
+		prefix += " "
+	}
+	entry.lines = []string{prefix + quoted + entry.comment}
+	entry.valueColumn = len(prefix) + 1
+	return nil
+}
+
+// splitKey splits key into the section it is in and its key within the
+// section. A key like db.Port is in the section db, and other keys are not in
+// a section. It reports whether the document has a header for the section.
+func (d *Document) splitKey(key string) (string, string, bool) {
+	for _, entry := range d.entries {
+		if entry.header && strings.HasPrefix(key, entry.section+".") {
+			return entry.section, key[len(entry.section)+1:], true
+		}
+	}
+	if section, name, ok := strings.Cut(key, "."); ok && section != "" && name != "" {
+		return section, name, false
+	}
+	return "", key, true
+}
+
+// insertIndex returns the index to insert a new key of section at, which is
+// after the last key of the first block of the section, or after its header if
+// it has no keys. Keys in @if blocks are passed over, so that the new key is
+// not made conditional. Keys that are not in a section go before the first
+// section header, or at the end of a document without sections.
+func (d *Document) insertIndex(section string) int {
+	// at is the index after the last key of the section seen so far.
+	at := -1
+	inSection := section == ""
+	for i, entry := range d.entries {
+		switch {
+		case entry.header && inSection && at == -1:
+			// The comment right above the header belongs to the section.
+			j := i
+			for j > 0 && d.entries[j-1].isComment() {
+				j--
+			}
+			return j
+		case entry.header && inSection:
+			return at
+		case entry.header && entry.section == section:
+			inSection = true
+			at = i + 1
+		case inSection && entry.key != "" && !entry.conditional:
+			at = i + 1
+		}
+	}
+	if at == -1 || section == "" {
+		return len(d.entries)
+	}
+	return at
+}
+
+// isComment reports whether e is a comment line.
+func (e docEntry) isComment() bool {
+	return e.key == "" && !e.header && isComment(strings.TrimLeftFunc(e.lines[0], unicode.IsSpace), "#")
+}
+
+// Comment returns the comment block immediately above the first definition of
+// key, with the # and one space removed from each line and the lines joined by
+// newlines. A blank line ends the block. Comment returns the empty string if
+// key is not defined or has no comment above it.
+func (d *Document) Comment(key string) string {
+	index := -1
+	for i, entry := range d.entries {
+		if entry.key == key {
+			index = i
+			break
+		}
+	}
+
+	var lines []string
+	for i := index - 1; i >= 0; i-- {
+		entry := d.entries[i]
+		if !entry.isComment() {
+			break
+		}
+		text := strings.TrimLeftFunc(entry.lines[0], unicode.IsSpace)
+		lines = append([]string{strings.TrimPrefix(text[1:], " ")}, lines...)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Bytes returns the document as a config file.
+func (d *Document) Bytes() []byte {
+	newline := d.newline
+	if newline == "" {
+		newline = "\n"
+	}
+	var buf bytes.Buffer
+	if d.bom {
+		buf.WriteString(byteOrderMark)
+	}
+	for _, entry := range d.entries {
+		for _, line := range entry.lines {
+			buf.WriteString(line)
+			buf.WriteString(newline)
+		}
+	}
+	return buf.Bytes()
+}
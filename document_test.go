@@ -0,0 +1,207 @@
+package itkconfig
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDocumentSet(t *testing.T) {
+	doc, err := LoadDocument("test_configs/document.cfg")
+	if err != nil {
+		t.Fatalf("Could not parse document: %s", err.Error())
+	}
+
+	if err := doc.Set("Port", "9000"); err != nil {
+		t.Fatalf("Could not set key: %s", err.Error())
+	}
+	if err := doc.Set("Name", "my app # web"); err != nil {
+		t.Fatalf("Could not add key: %s", err.Error())
+	}
+
+	want := `# Settings for the web server
+
+# Port that the webservice is listening to
+Port = 9000 # must be above 1024
+Host = localhost
+
+  # Admins
+Admin = foo@example.com
+Admin = bar@example.com
+Name = "my app # web"
+`
+	if got := string(doc.Bytes()); got != want {
+		t.Fatalf(`
+Document was not written back correctly.
+	expected: %q
+	got:      %q`, want, got)
+	}
+
+	type Config struct {
+		Port  int
+		Host  string
+		Admin []string
+		Name  string
+	}
+	config := Config{}
+	if err := LoadConfigString(string(doc.Bytes()), &config); err != nil {
+		t.Fatalf("Could not load edited document: %s", err.Error())
+	}
+	if config.Port != 9000 || config.Name != "my app # web" {
+		t.Fatalf("Edited document has wrong values: %#v", config)
+	}
+}
+
+func TestDocumentSetRepeatedKey(t *testing.T) {
+	doc, err := ParseDocument([]byte("Admin = a\nAdmin = b\n"))
+	if err != nil {
+		t.Fatalf("Could not parse document: %s", err.Error())
+	}
+	err = doc.Set("Admin", "c")
+	if err == nil || !strings.Contains(err.Error(), "defined multiple times") {
+		t.Fatalf("Setting a repeated key should not be allowed, got: %v", err)
+	}
+}
+
+func TestDocumentUnchanged(t *testing.T) {
+	for _, data := range []string{
+		"\uFEFF# comment\nFoo = \"\"\"\nmulti\nline\"\"\"\nBar = a \\\n  b\n",
+		"# comment\r\nFoo = \"\"\"\r\nmulti\r\nline\"\"\"\r\nBar = a \\\r\n  b\r\n",
+	} {
+		doc, err := ParseDocument([]byte(data))
+		if err != nil {
+			t.Fatalf("Could not parse document: %s", err.Error())
+		}
+		if got := string(doc.Bytes()); got != data {
+			t.Fatalf(`
+Unchanged document should be written back as is.
+	expected: %q
+	got:      %q`, data, got)
+		}
+	}
+}
+
+func TestDocumentComment(t *testing.T) {
+	data := `# Settings for the web server
+
+# Port that the webservice is listening to.
+# Must be above 1024.
+Port = 8000
+Host = localhost
+
+  # Admins
+Admin = foo@example.com
+`
+	doc, err := ParseDocument([]byte(data))
+	if err != nil {
+		t.Fatalf("Could not parse document: %s", err.Error())
+	}
+
+	tests := map[string]string{
+		"Port":    "Port that the webservice is listening to.\nMust be above 1024.",
+		"Host":    "",
+		"Admin":   "Admins",
+		"Missing": "",
+	}
+	for key, want := range tests {
+		if got := doc.Comment(key); got != want {
+			t.Fatalf(`
+Wrong comment for key %s.
+	expected: %#v
+	got:      %#v`, key, want, got)
+		}
+	}
+}
+
+func TestDocumentSetSection(t *testing.T) {
+	doc, err := ParseDocument([]byte("Name = web\n\n# Database\n[db]\nHost = x\n\n[cache]\n"))
+	if err != nil {
+		t.Fatalf("Could not parse document: %s", err.Error())
+	}
+	for _, kv := range [][2]string{{"Port", "2"}, {"db.Port", "5432"}, {"cache.Size", "100"}, {"db.Host", "y"}} {
+		if err := doc.Set(kv[0], kv[1]); err != nil {
+			t.Fatalf("Could not set key %s: %s", kv[0], err.Error())
+		}
+	}
+
+	want := "Name = web\nPort = 2\n\n# Database\n[db]\nHost = y\nPort = 5432\n\n[cache]\nSize = 100\n"
+	if got := string(doc.Bytes()); got != want {
+		t.Fatalf(`
+Keys were not added to their sections.
+	expected: %q
+	got:      %q`, want, got)
+	}
+
+	doc, err = ParseDocument([]byte("# Database\n[db]\nHost = x\n"))
+	if err != nil {
+		t.Fatalf("Could not parse document: %s", err.Error())
+	}
+	if err := doc.Set("Port", "2"); err != nil {
+		t.Fatalf("Could not set key: %s", err.Error())
+	}
+	want = "Port = 2\n# Database\n[db]\nHost = x\n"
+	if got := string(doc.Bytes()); got != want {
+		t.Fatalf(`
+Key was not added before the first section.
+	expected: %q
+	got:      %q`, want, got)
+	}
+
+	doc, err = ParseDocument([]byte("Name = web\n"))
+	if err != nil {
+		t.Fatalf("Could not parse document: %s", err.Error())
+	}
+	for _, kv := range [][2]string{{"db.Port", "5432"}, {"db.Host", "x"}, {"Port", "2"}} {
+		if err := doc.Set(kv[0], kv[1]); err != nil {
+			t.Fatalf("Could not set key %s: %s", kv[0], err.Error())
+		}
+	}
+	want = "Name = web\nPort = 2\n\n[db]\nPort = 5432\nHost = x\n"
+	if got := string(doc.Bytes()); got != want {
+		t.Fatalf(`
+Missing section was not added.
+	expected: %q
+	got:      %q`, want, got)
+	}
+	got := map[string]string{}
+	if err := Unmarshal(doc.Bytes(), &got); err != nil {
+		t.Fatalf("Could not load document with added section: %s", err.Error())
+	}
+	if got["db.Port"] != "5432" {
+		t.Fatalf("Key in added section was not loaded: %#v", got)
+	}
+}
+
+func TestDocumentZeroValue(t *testing.T) {
+	var doc Document
+	if err := doc.Set("Port", "8000"); err != nil {
+		t.Fatalf("Could not set key in empty document: %s", err.Error())
+	}
+	want := "Port = 8000\n"
+	if got := string(doc.Bytes()); got != want {
+		t.Fatalf(`
+Zero value document written wrong.
+	expected: %q
+	got:      %q`, want, got)
+	}
+}
+
+func TestDocumentConditionalBlock(t *testing.T) {
+	doc, err := ParseDocument([]byte("Port = 8000\n@if ENV=prod\nTLSCert = app.pem\n@endif\n"))
+	if err != nil {
+		t.Fatalf("Could not parse document: %s", err.Error())
+	}
+	if err := doc.Set("TLSCert", "prod.pem"); err != nil {
+		t.Fatalf("Could not set key in conditional block: %s", err.Error())
+	}
+	if err := doc.Set("Host", "localhost"); err != nil {
+		t.Fatalf("Could not add key: %s", err.Error())
+	}
+
+	want := "Port = 8000\n@if ENV=prod\nTLSCert = prod.pem\n@endif\nHost = localhost\n"
+	if got := string(doc.Bytes()); got != want {
+		t.Fatalf(`
+Document with conditional block was not written back correctly.
+	expected: %q
+	got:      %q`, want, got)
+	}
+}
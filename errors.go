@@ -0,0 +1,100 @@
+// Copyright (c) 2014 Trygve Aaberge and contributors
+// Released under the LGPLv2.1, see LICENSE
+
+package itkconfig
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrSyntax is matched by errors.Is for all errors caused by a line in a
+	// config file.
+	ErrSyntax = errors.New("syntax error")
+	// ErrUnknownKey is matched by errors.Is for an UnknownKeyError.
+	ErrUnknownKey = errors.New("unknown key")
+)
+
+// A ParseError is returned for an error caused by a line in a config file.
+// It matches ErrSyntax with errors.Is.
+type ParseError struct {
+	// File is the name of the config file, or a description of its source
+	// like "<reader>".
+	File string
+	// Line and Column give the position of the error. Column is a 1-based
+	// byte offset into the line.
+	Line   uint
+	Column int
+	// Text is the line as written, shortened if it is long.
+	Text string
+	// Msg describes the error.
+	Msg string
+	// Err is the underlying error, if any.
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("syntax error parsing config (%s:%d:%d) in %q: %s", e.File, e.Line, e.Column, e.Text, e.Msg)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ParseError) Is(target error) bool {
+	return target == ErrSyntax
+}
+
+// An UnknownKeyError is returned when a config file contains a key that does
+// not match any field of the config struct.
+type UnknownKeyError struct {
+	Key  string
+	Line uint
+}
+
+func (e *UnknownKeyError) Error() string {
+	return fmt.Sprintf("the config key '%s' is not defined", e.Key)
+}
+
+func (e *UnknownKeyError) Is(target error) bool {
+	return target == ErrUnknownKey
+}
+
+// A TypeError is returned when a value can not be parsed as the type of the
+// field it sets.
+type TypeError struct {
+	Key   string
+	Value string
+	// Type describes what the value was parsed as, such as "int".
+	Type string
+	// Err is the underlying error, if any.
+	Err error
+}
+
+func (e *TypeError) Error() string {
+	msg := fmt.Sprintf("invalid %s \"%s\" in key \"%s\"", e.Type, e.Value, e.Key)
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *TypeError) Unwrap() error {
+	return e.Err
+}
+
+// A RangeError is returned when a number is outside the range allowed by the
+// min, max, nonneg or finite options of its field.
+type RangeError struct {
+	Key string
+	// Value is the number as parsed, which may be written differently in the
+	// config file, like 0x10 for 16.
+	Value string
+	// Msg describes the range, like "is above the maximum of 10".
+	Msg string
+}
+
+func (e *RangeError) Error() string {
+	return fmt.Sprintf("value %s in key \"%s\" %s", e.Value, e.Key, e.Msg)
+}
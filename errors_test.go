@@ -0,0 +1,95 @@
+package itkconfig
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+)
+
+func TestUnknownKeyError(t *testing.T) {
+	type Config struct {
+		Foo string
+	}
+
+	err := LoadConfigString("Foo = bar\n\nBar = baz\n", &Config{})
+	var unknownKey *UnknownKeyError
+	if !errors.As(err, &unknownKey) {
+		t.Fatalf("Error should be an UnknownKeyError, got: %v", err)
+	}
+	if unknownKey.Key != "Bar" || unknownKey.Line != 3 {
+		t.Fatalf("UnknownKeyError has wrong fields. Expected: Key 'Bar' on line 3, got: Key '%s' on line %d", unknownKey.Key, unknownKey.Line)
+	}
+	want := "syntax error parsing config (<string>:3:1) in \"Bar = baz\": the config key 'Bar' is not defined"
+	if err.Error() != want {
+		t.Fatalf("Error message changed. Expected: %s, got: %s", want, err.Error())
+	}
+}
+
+func TestTypeError(t *testing.T) {
+	type Config struct {
+		Port int
+	}
+
+	err := LoadConfigString("Port = eighty", &Config{})
+	var typeErr *TypeError
+	if !errors.As(err, &typeErr) {
+		t.Fatalf("Error should be a TypeError, got: %v", err)
+	}
+	if typeErr.Key != "Port" || typeErr.Value != "eighty" || typeErr.Type != "int" {
+		t.Fatalf("TypeError has wrong fields: %#v", typeErr)
+	}
+	if !errors.Is(err, strconv.ErrSyntax) {
+		t.Fatalf("TypeError should wrap the parse error, got: %v", err)
+	}
+
+	var unknownKey *UnknownKeyError
+	if errors.As(err, &unknownKey) {
+		t.Fatal("TypeError should not be an UnknownKeyError.")
+	}
+}
+
+func TestSentinelErrors(t *testing.T) {
+	type Config struct {
+		Port int
+	}
+
+	err := LoadConfigString("Host = localhost", &Config{})
+	if !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("Unknown key error should match ErrUnknownKey, got: %v", err)
+	}
+	if !errors.Is(err, ErrSyntax) {
+		t.Fatalf("Unknown key error should match ErrSyntax, got: %v", err)
+	}
+
+	err = LoadConfigString("Port", &Config{})
+	if !errors.Is(err, ErrSyntax) {
+		t.Fatalf("Line without '=' should match ErrSyntax, got: %v", err)
+	}
+	if errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("Line without '=' should not match ErrUnknownKey, got: %v", err)
+	}
+
+	err = LoadConfigString("Port = 80", &Config{})
+	if errors.Is(err, ErrSyntax) {
+		t.Fatalf("Valid config should not give an error, got: %v", err)
+	}
+}
+
+func TestParseError(t *testing.T) {
+	type Config struct {
+		Name int
+	}
+
+	err := LoadConfigWithOptions("test_configs/map.cfg", &Config{}, Options{AllowUnknownKeys: true})
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) {
+		t.Fatalf("Error should be a ParseError, got: %v", err)
+	}
+	if parseErr.File != "test_configs/map.cfg" || parseErr.Line != 2 || parseErr.Column != 8 {
+		t.Fatalf("ParseError has the wrong position: %#v", parseErr)
+	}
+	var typeErr *TypeError
+	if !errors.As(parseErr.Err, &typeErr) || parseErr.Msg != typeErr.Error() {
+		t.Fatalf("ParseError should wrap the TypeError: %#v", parseErr)
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright (c) 2014 Trygve Aaberge and contributors
+// Released under the LGPLv2.1, see LICENSE
+
+package itkconfig
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// quoteVal escapes a string value, and quotes it if it can not be written as
+// is, so that it is read back unchanged by the parser.
+func quoteVal(key, value string) (string, error) {
+	if strings.ContainsAny(value, "\r\n") {
+		return "", fmt.Errorf("cannot marshal key \"%s\": value contains a newline", key)
+	}
+	// Every backslash is escaped, which also keeps a backslash at the end
+	// from continuing the line.
+	value = strings.ReplaceAll(value, "\\", "\\\\")
+	value = strings.ReplaceAll(value, "$", "$$")
+	// A value starting with [ is quoted so it is not read back as an inline
+	// list, and one starting with @ so it is not read back as the name of a
+	// file to read the value from.
+	if !strings.ContainsAny(value, "#\"") && value == strings.TrimSpace(value) && !strings.HasPrefix(value, "[") && !strings.HasPrefix(value, "@") {
+		return value, nil
+	}
+	return "\"" + strings.ReplaceAll(value, "\"", "\\\"") + "\"", nil
+}
+
+// formatField formats a value as it is written in a config file. It is the
+// inverse of parseField.
+func formatField(key string, value reflect.Value, options map[string]string) (string, error) {
+	if _, ok := options["json"]; ok {
+		data, err := json.Marshal(value.Interface())
+		if err != nil {
+			return "", fmt.Errorf("cannot marshal key \"%s\": %s", key, err)
+		}
+		return string(data), nil
+	}
+
+	if value.Type() == timeType {
+		layout, ok := options["layout"]
+		if !ok {
+			layout = time.RFC3339
+		}
+		return value.Interface().(time.Time).Format(layout), nil
+	}
+
+	if value.Type() == durationType {
+		return value.Interface().(time.Duration).String(), nil
+	}
+
+	if value.Type() == fileModeType {
+		return fmt.Sprintf("%04o", value.Uint()), nil
+	}
+
+	if value.Type() == ipNetType {
+		ipNet := value.Interface().(net.IPNet)
+		return ipNet.String(), nil
+	}
+
+	if value.Type() == urlType {
+		u := value.Interface().(url.URL)
+		return quoteVal(key, u.String())
+	}
+
+	if marshaler, ok := value.Interface().(encoding.TextMarshaler); ok {
+		text, err := marshaler.MarshalText()
+		if err != nil {
+			return "", fmt.Errorf("cannot marshal key \"%s\": %s", key, err)
+		}
+		return quoteVal(key, string(text))
+	}
+
+	if value.Type() == rawType {
+		if strings.ContainsAny(value.String(), "\r\n") {
+			return "", fmt.Errorf("cannot marshal key \"%s\": value contains a newline", key)
+		}
+		return value.String(), nil
+	}
+
+	if _, ok := options["char"]; ok && value.Kind() == reflect.Int32 {
+		return quoteVal(key, string(rune(value.Int())))
+	}
+
+	switch value.Kind() {
+	case reflect.String:
+		return quoteVal(key, value.String())
+	case reflect.Bool:
+		return strconv.FormatBool(value.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(value.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(value.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(value.Float(), 'g', -1, value.Type().Bits()), nil
+	case reflect.Slice:
+		if value.Type().Elem().Kind() != reflect.Uint8 {
+			return "", fmt.Errorf("cannot marshal key \"%s\": unsupported type: %s of %s", key, value.Kind(), value.Type().Elem().Kind())
+		}
+		if _, ok := options["raw"]; ok {
+			return quoteVal(key, string(value.Bytes()))
+		}
+		return base64.StdEncoding.EncodeToString(value.Bytes()), nil
+	case reflect.Ptr, reflect.Interface:
+		return formatField(key, value.Elem(), options)
+	default:
+		return "", fmt.Errorf("cannot marshal key \"%s\": unsupported type: %s", key, value.Kind())
+	}
+}
+
+// Marshal returns the config file representation of config, which has to be a
+// struct or a pointer to a struct. Every exported field is written as a
+// key-value pair in declaration order, and slices are written as one pair per
+// element in slice order. Nil pointers and interfaces are left out. Sections
+// are written after the other fields, with a [section] header for each
+// element of a slice of sections. The result can be read back with
+// LoadConfig.
+func Marshal(config interface{}) ([]byte, error) {
+	configReflect := reflect.ValueOf(config)
+	if configReflect.Kind() == reflect.Ptr {
+		configReflect = configReflect.Elem()
+	}
+	if configReflect.Kind() != reflect.Struct {
+		return nil, errors.New("config argument must be a struct or a pointer to a struct")
+	}
+
+	fields := cachedFields(configReflect.Type(), FieldNameKeys)
+	if fields.err != nil {
+		return nil, fields.err
+	}
+
+	var buf bytes.Buffer
+	sections, err := marshalFields(&buf, configReflect, fields)
+	if err != nil {
+		return nil, err
+	}
+	for _, section := range sections {
+		value, _ := configReflect.FieldByIndexErr(section.index)
+		elems := []reflect.Value{value}
+		if value.Kind() == reflect.Slice {
+			elems = elems[:0]
+			for i := 0; i < value.Len(); i++ {
+				elems = append(elems, value.Index(i))
+			}
+		}
+
+		for _, elem := range elems {
+			if elem.Kind() == reflect.Ptr {
+				if elem.IsNil() {
+					continue
+				}
+				elem = elem.Elem()
+			}
+			sectionFields := cachedFields(elem.Type(), FieldNameKeys)
+			if sectionFields.err != nil {
+				return nil, sectionFields.err
+			}
+			fmt.Fprintf(&buf, "\n[%s]\n", section.key)
+			nested, err := marshalFields(&buf, elem, sectionFields)
+			if err != nil {
+				return nil, err
+			}
+			if len(nested) > 0 {
+				return nil, fmt.Errorf("cannot marshal key \"%s.%s\": sections can not be nested", section.key, nested[0].key)
+			}
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// marshalFields writes the exported fields of the struct v to buf as
+// key-value pairs, except for sections, which it returns for the caller to
+// write.
+func marshalFields(buf *bytes.Buffer, v reflect.Value, fields *typeFields) ([]configField, error) {
+	var sections []configField
+	for _, field := range fields.list {
+		structField := v.Type().FieldByIndex(field.index)
+		if !structField.IsExported() {
+			continue
+		}
+		// Fields of nil embedded structs are left out.
+		value, err := v.FieldByIndexErr(field.index)
+		if err != nil {
+			continue
+		}
+		if isSection(value.Type()) && !isJSON(field) {
+			sections = append(sections, field)
+			continue
+		}
+
+		values := []reflect.Value{value}
+		if isList(values[0].Type()) && !isJSON(field) {
+			slice := values[0]
+			values = values[:0]
+			for i := 0; i < slice.Len(); i++ {
+				values = append(values, slice.Index(i))
+			}
+		}
+
+		for _, v := range values {
+			if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+				continue
+			}
+			s, err := formatField(field.key, v, field.options)
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(buf, "%s = %s\n", strings.ReplaceAll(field.key, "=", "\\="), s)
+		}
+	}
+	return sections, nil
+}
+
+// WriteConfigFile writes the config file representation of config, as
+// returned by Marshal, to filename. The file is written atomically by writing
+// to a temporary file in the same directory, which is then renamed to
+// filename. If filename already exists its permissions are kept, otherwise it
+// is created with permissions 0600.
+func WriteConfigFile(filename string, config interface{}) error {
+	data, err := Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	mode := os.FileMode(0600)
+	if info, err := os.Stat(filename); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(mode)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), filename)
+}
@@ -0,0 +1,554 @@
+package itkconfig
+
+import (
+	"bytes"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMarshal(t *testing.T) {
+	type Config struct {
+		Port       int
+		Debug      bool
+		AdminEmail []string `itkconfig:"admin_email"`
+	}
+
+	config := Config{
+		Port:       8000,
+		Debug:      true,
+		AdminEmail: []string{"foo@mailinator.com", "bar@mailinator.com"},
+	}
+	data, err := Marshal(&config)
+	if err != nil {
+		t.Fatalf("Could not marshal config: %s", err.Error())
+	}
+
+	want := "Port = 8000\nDebug = true\nadmin_email = foo@mailinator.com\nadmin_email = bar@mailinator.com\n"
+	if string(data) != want {
+		t.Fatalf(`
+Marshaled config incorrectly.
+	expected: %q
+	got:      %q`, want, string(data))
+	}
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	type Config struct {
+		Name     string
+		Comment  string
+		Quoted   string
+		Padded   string
+		Empty    string
+		Price    string
+		Handle   string
+		Count    uint16
+		Offset   int8
+		Ratio    float64
+		Enabled  bool
+		Day      time.Time `itkconfig:"layout=2006-01-02"`
+		Wait     time.Duration
+		Perm     os.FileMode
+		Values   []float32
+		Messages []string
+		Blob     Raw
+	}
+
+	config := Config{
+		Name:     "itkconfig",
+		Comment:  "#not a comment",
+		Quoted:   "say \"hi\" # twice",
+		Padded:   "  spaces  ",
+		Empty:    "",
+		Price:    "$5 ${HOME}",
+		Handle:   "@itk",
+		Count:    65535,
+		Offset:   -128,
+		Ratio:    0.1,
+		Enabled:  true,
+		Day:      time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC),
+		Wait:     1500 * time.Millisecond,
+		Perm:     0640,
+		Values:   []float32{1.5, -2},
+		Messages: []string{"first", "second # with hash"},
+		Blob:     `{"a": "#1"} # raw`,
+	}
+	data, err := Marshal(config)
+	if err != nil {
+		t.Fatalf("Could not marshal config: %s", err.Error())
+	}
+
+	got := Config{}
+	err = LoadConfigFromReader(bytes.NewReader(data), &got)
+	if err != nil {
+		t.Fatalf("Could not load marshaled config: %s\n%s", err.Error(), data)
+	}
+
+	if !reflect.DeepEqual(config, got) {
+		t.Fatalf(`
+Marshaled config did not round-trip.
+	expected: %#v
+	got:      %#v`, config, got)
+	}
+}
+
+func TestMarshalNewline(t *testing.T) {
+	type Config struct {
+		Foo string
+	}
+
+	_, err := Marshal(Config{Foo: "two\nlines"})
+	if err == nil {
+		t.Fatal("Marshaling a value containing a newline should not be allowed.")
+	}
+}
+
+func TestMarshalPointer(t *testing.T) {
+	type Config struct {
+		Port *int
+		Name *string
+	}
+
+	port := 8000
+	data, err := Marshal(Config{Port: &port})
+	if err != nil {
+		t.Fatalf("Could not marshal config: %s", err.Error())
+	}
+
+	want := "Port = 8000\n"
+	if string(data) != want {
+		t.Fatalf(`
+Marshaled config with pointers incorrectly.
+	expected: %q
+	got:      %q`, want, string(data))
+	}
+}
+
+func TestMarshalTextMarshaler(t *testing.T) {
+	type Config struct {
+		Level  LogLevel
+		Levels []LogLevel
+	}
+
+	data, err := Marshal(Config{Level: LogWarn, Levels: []LogLevel{LogDebug, LogError}})
+	if err != nil {
+		t.Fatalf("Could not marshal config: %s", err.Error())
+	}
+
+	want := "Level = warn\nLevels = debug\nLevels = error\n"
+	if string(data) != want {
+		t.Fatalf(`
+Marshaled config with TextMarshaler incorrectly.
+	expected: %q
+	got:      %q`, want, string(data))
+	}
+}
+
+func TestMarshalEmbeddedStruct(t *testing.T) {
+	type Config struct {
+		BaseConfig
+		*ExtraConfig
+		Port int
+	}
+
+	data, err := Marshal(Config{BaseConfig: BaseConfig{LogLevel: "debug"}, Port: 8000})
+	if err != nil {
+		t.Fatalf("Could not marshal config: %s", err.Error())
+	}
+
+	want := "LogLevel = debug\nPort = 8000\n"
+	if string(data) != want {
+		t.Fatalf(`
+Marshaled config with embedded structs incorrectly.
+	expected: %q
+	got:      %q`, want, string(data))
+	}
+}
+
+func TestMarshalBytes(t *testing.T) {
+	type Config struct {
+		SigningKey []byte
+		Password   []byte `itkconfig:"raw"`
+	}
+
+	config := Config{
+		SigningKey: []byte("hello"),
+		Password:   []byte("s3cr3t # with hash"),
+	}
+	data, err := Marshal(config)
+	if err != nil {
+		t.Fatalf("Could not marshal config: %s", err.Error())
+	}
+
+	want := "SigningKey = aGVsbG8=\nPassword = \"s3cr3t # with hash\"\n"
+	if string(data) != want {
+		t.Fatalf(`
+Marshaled config with byte slices incorrectly.
+	expected: %q
+	got:      %q`, want, string(data))
+	}
+}
+
+func TestMarshalEscapedEquals(t *testing.T) {
+	type Config struct {
+		Page  string `itkconfig:"/path?page=1"`
+		Plain string
+	}
+
+	config := Config{Page: "index=2", Plain: "a\\=b"}
+	data, err := Marshal(config)
+	if err != nil {
+		t.Fatalf("Could not marshal config: %s", err.Error())
+	}
+
+	got := Config{}
+	err = LoadConfigFromReader(bytes.NewReader(data), &got)
+	if err != nil {
+		t.Fatalf("Could not load marshaled config: %s\n%s", err.Error(), data)
+	}
+	if config != got {
+		t.Fatalf(`
+Marshaled config with equals signs did not round-trip.
+	expected: %#v
+	got:      %#v`, config, got)
+	}
+}
+
+func TestMarshalIP(t *testing.T) {
+	type Config struct {
+		BindAddr    net.IP
+		AllowedCIDR net.IPNet
+	}
+
+	_, cidr, _ := net.ParseCIDR("10.0.0.0/8")
+	data, err := Marshal(Config{BindAddr: net.IPv4(192, 168, 1, 1), AllowedCIDR: *cidr})
+	if err != nil {
+		t.Fatalf("Could not marshal config: %s", err.Error())
+	}
+
+	want := "BindAddr = 192.168.1.1\nAllowedCIDR = 10.0.0.0/8\n"
+	if string(data) != want {
+		t.Fatalf(`
+Marshaled config with IP addresses incorrectly.
+	expected: %q
+	got:      %q`, want, string(data))
+	}
+}
+
+func TestMarshalURL(t *testing.T) {
+	type Config struct {
+		Endpoint *url.URL
+	}
+
+	endpoint, _ := url.Parse("http://example.com/v2?a=b#top")
+	data, err := Marshal(Config{Endpoint: endpoint})
+	if err != nil {
+		t.Fatalf("Could not marshal config: %s", err.Error())
+	}
+
+	want := "Endpoint = \"http://example.com/v2?a=b#top\"\n"
+	if string(data) != want {
+		t.Fatalf(`
+Marshaled config with URL incorrectly.
+	expected: %q
+	got:      %q`, want, string(data))
+	}
+}
+
+func TestWriteConfigFile(t *testing.T) {
+	type Config struct {
+		Port       int
+		AdminEmail []string
+	}
+
+	filename := filepath.Join(t.TempDir(), "myapp.config")
+	config := Config{
+		Port:       8000,
+		AdminEmail: []string{"foo@mailinator.com", "bar@mailinator.com"},
+	}
+	err := WriteConfigFile(filename, &config)
+	if err != nil {
+		t.Fatalf("Could not write config file: %s", err.Error())
+	}
+
+	got := Config{}
+	err = LoadConfig(filename, &got)
+	if err != nil {
+		t.Fatalf("Could not load written config file: %s", err.Error())
+	}
+	if !reflect.DeepEqual(config, got) {
+		t.Fatalf(`
+Written config file did not round-trip.
+	expected: %#v
+	got:      %#v`, config, got)
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(filename))
+	if err != nil {
+		t.Fatalf("Could not read directory: %s", err.Error())
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Temporary file should be removed, found %d files", len(entries))
+	}
+}
+
+func TestWriteConfigFileKeepsPermissions(t *testing.T) {
+	type Config struct {
+		Port int
+	}
+
+	filename := filepath.Join(t.TempDir(), "myapp.config")
+	err := os.WriteFile(filename, []byte("Port = 80\n"), 0640)
+	if err != nil {
+		t.Fatalf("Could not create config file: %s", err.Error())
+	}
+	err = os.Chmod(filename, 0640)
+	if err != nil {
+		t.Fatalf("Could not change permissions of config file: %s", err.Error())
+	}
+
+	err = WriteConfigFile(filename, Config{Port: 8000})
+	if err != nil {
+		t.Fatalf("Could not write config file: %s", err.Error())
+	}
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatalf("Could not stat config file: %s", err.Error())
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Fatalf("Permissions should be kept. Expected: %o, got: %o", 0640, info.Mode().Perm())
+	}
+}
+
+func TestMarshalDeterministic(t *testing.T) {
+	type Config struct {
+		Zulu  string
+		Alpha int
+		BaseConfig
+		Mike    []string
+		Charlie bool
+	}
+
+	config := Config{
+		Zulu:       "z",
+		Alpha:      1,
+		BaseConfig: BaseConfig{LogLevel: "debug", Tags: []string{"b", "a"}},
+		Mike:       []string{"3", "1", "2"},
+		Charlie:    true,
+	}
+	first, err := Marshal(config)
+	if err != nil {
+		t.Fatalf("Could not marshal config: %s", err.Error())
+	}
+
+	want := "Zulu = z\nAlpha = 1\nLogLevel = debug\nTags = b\nTags = a\nMike = 3\nMike = 1\nMike = 2\nCharlie = true\n"
+	if string(first) != want {
+		t.Fatalf(`
+Marshaled config not in declaration order.
+	expected: %q
+	got:      %q`, want, string(first))
+	}
+
+	for i := 0; i < 10; i++ {
+		again, err := Marshal(config)
+		if err != nil {
+			t.Fatalf("Could not marshal config: %s", err.Error())
+		}
+		if !bytes.Equal(first, again) {
+			t.Fatalf(`
+Marshaling the same config twice gave different output.
+	first: %q
+	again: %q`, string(first), string(again))
+		}
+	}
+}
+
+func TestMarshalChar(t *testing.T) {
+	type Config struct {
+		Delimiter rune `itkconfig:"char"`
+		Separator rune `itkconfig:"char"`
+	}
+
+	config := Config{Delimiter: ',', Separator: ' '}
+	data, err := Marshal(config)
+	if err != nil {
+		t.Fatalf("Could not marshal config: %s", err.Error())
+	}
+
+	got := Config{}
+	err = LoadConfigFromReader(bytes.NewReader(data), &got)
+	if err != nil {
+		t.Fatalf("Could not load marshaled config: %s\n%s", err.Error(), data)
+	}
+	if config != got {
+		t.Fatalf(`
+Marshaled config with characters did not round-trip.
+	expected: %#v
+	got:      %#v`, config, got)
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	type Config struct {
+		Name  string
+		Port  int
+		Debug bool
+		Tags  []string
+	}
+
+	data := []byte("Name = web\nPort = 8000\nDebug = true\nTags = a\nTags = b\n")
+	config := Config{}
+	if err := Unmarshal(data, &config); err != nil {
+		t.Fatalf("Could not unmarshal config: %s", err.Error())
+	}
+	want := Config{Name: "web", Port: 8000, Debug: true, Tags: []string{"a", "b"}}
+	if !reflect.DeepEqual(want, config) {
+		t.Fatalf(`
+Unmarshaled config is wrong.
+	expected: %#v
+	got:      %#v`, want, config)
+	}
+}
+
+func TestMarshalJSON(t *testing.T) {
+	type Server struct {
+		Host string
+		Port int
+	}
+	type Config struct {
+		Server Server   `itkconfig:"json"`
+		Tags   []string `itkconfig:"json"`
+	}
+
+	config := Config{Server: Server{Host: "a # b", Port: 80}, Tags: []string{"x", "y"}}
+	data, err := Marshal(config)
+	if err != nil {
+		t.Fatalf("Could not marshal config: %s", err.Error())
+	}
+
+	got := Config{}
+	err = LoadConfigFromReader(bytes.NewReader(data), &got)
+	if err != nil {
+		t.Fatalf("Could not load marshaled config: %s\n%s", err.Error(), data)
+	}
+	if !reflect.DeepEqual(config, got) {
+		t.Fatalf(`
+Marshaled config with JSON fields did not round-trip.
+	expected: %#v
+	got:      %#v`, config, got)
+	}
+}
+
+func TestMarshalSections(t *testing.T) {
+	type Database struct {
+		Host string
+		Port int
+	}
+	type Server struct {
+		Name string
+	}
+	type Config struct {
+		Name     string
+		Database Database  `itkconfig:"database"`
+		Cache    *Database `itkconfig:"cache"`
+		Servers  []Server  `itkconfig:"server"`
+		Debug    bool
+	}
+
+	config := Config{
+		Name:     "web",
+		Database: Database{Host: "db.example.com", Port: 5432},
+		Servers:  []Server{{Name: "a"}, {Name: "b"}},
+		Debug:    true,
+	}
+	data, err := Marshal(config)
+	if err != nil {
+		t.Fatalf("Could not marshal config with sections: %s", err.Error())
+	}
+	want := "Name = web\nDebug = true\n\n[database]\nHost = db.example.com\nPort = 5432\n\n[server]\nName = a\n\n[server]\nName = b\n"
+	if string(data) != want {
+		t.Fatalf(`
+Config with sections marshaled wrong.
+	expected: %#v
+	got:      %#v`, want, string(data))
+	}
+
+	got := Config{}
+	if err := Unmarshal(data, &got); err != nil {
+		t.Fatalf("Could not load marshaled config: %s\n%s", err.Error(), data)
+	}
+	if !reflect.DeepEqual(config, got) {
+		t.Fatalf(`
+Marshaled config with sections did not round-trip.
+	expected: %#v
+	got:      %#v`, config, got)
+	}
+}
+
+func TestMarshalTrailingBackslash(t *testing.T) {
+	type Config struct {
+		Dir   string
+		Share string
+		Next  string
+	}
+
+	config := Config{Dir: "C:\\", Share: "\\\\server\\a # b\\", Next: "x"}
+	data, err := Marshal(config)
+	if err != nil {
+		t.Fatalf("Could not marshal config: %s", err.Error())
+	}
+
+	got := Config{}
+	if err := Unmarshal(data, &got); err != nil {
+		t.Fatalf("Could not load marshaled config: %s\n%s", err.Error(), data)
+	}
+	if config != got {
+		t.Fatalf(`
+Marshaled values ending with a backslash did not round-trip.
+	expected: %#v
+	got:      %#v`, config, got)
+	}
+}
+
+func TestMarshalBackslashRoundTrip(t *testing.T) {
+	type Config struct {
+		Value string
+	}
+
+	for _, value := range []string{
+		"a\\\"b",
+		"a\\\\\"",
+		"\\\"",
+		"a\\=b",
+		"a\\\\=b",
+		"C:\\",
+		"C:\\\\",
+		"\\\\server\\share",
+		"\\$$",
+		"\\@itk",
+		"\\\\@itk",
+		"@itk",
+	} {
+		config := Config{Value: value}
+		data, err := Marshal(config)
+		if err != nil {
+			t.Fatalf("Could not marshal %q: %s", value, err.Error())
+		}
+
+		got := Config{}
+		if err := Unmarshal(data, &got); err != nil {
+			t.Fatalf("Could not load marshaled config: %s\n%s", err.Error(), data)
+		}
+		if config != got {
+			t.Fatalf(`
+Marshaled value with backslashes did not round-trip.
+	expected: %#v
+	got:      %#v`, config, got)
+		}
+	}
+}